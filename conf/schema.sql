@@ -0,0 +1,83 @@
+-- 数据库表结构（MySQL），用于新建数据库；从旧版本升级请按编号依次执行conf/upgrade/下的脚本
+
+create table if not exists crawl_rules (
+    id int not null auto_increment,
+    domain varchar(191) not null,
+    urlpath varchar(512) not null,
+    xpath text not null,
+    cycle int not null default 0,
+    priority int not null default 0,
+    follow_links tinyint(1) not null default 0,
+    ignore_robots tinyint(1) not null default 0,
+    watch int not null default 0,
+    webhook varchar(1024) not null default '',
+    create_time datetime not null,
+    update_time datetime not null,
+    status int not null default 0,
+    primary key (id)
+) engine=InnoDB default charset=utf8mb4;
+
+create table if not exists crawl_tasks (
+    id int not null auto_increment,
+    domain varchar(191) not null,
+    urlpath varchar(512) not null,
+    xpath text not null,
+    priority int not null default 0,
+    cycle int not null default 0,
+    status int not null default 0,
+    last_crawl_time bigint not null default 0,
+    crawl_times int not null default 0,
+    lease_expire bigint not null default 0,
+    retry_times int not null default 0,
+    next_retry_time bigint not null default 0,
+    follow_links tinyint(1) not null default 0,
+    ignore_robots tinyint(1) not null default 0,
+    watch int not null default 0,
+    webhook varchar(1024) not null default '',
+    page_key varchar(512) not null default '',
+    data_key varchar(512) not null default '',
+    etag varchar(255) not null default '',
+    last_modified varchar(64) not null default '',
+    content_hash varchar(64) not null default '',
+    simhash bigint unsigned not null default 0,
+    simhash_band0 smallint unsigned not null default 0,
+    simhash_band1 smallint unsigned not null default 0,
+    simhash_band2 smallint unsigned not null default 0,
+    simhash_band3 smallint unsigned not null default 0,
+    duplicate_of int not null default 0,
+    create_time datetime not null,
+    update_time datetime not null,
+    primary key (id),
+    unique key uk_domain_urlpath (domain, urlpath),
+    key idx_status (status, next_retry_time),
+    key idx_simhash_band0 (simhash_band0),
+    key idx_simhash_band1 (simhash_band1),
+    key idx_simhash_band2 (simhash_band2),
+    key idx_simhash_band3 (simhash_band3)
+) engine=InnoDB default charset=utf8mb4;
+
+-- report_id的唯一索引用于忽略fetcher重复投递的报告，不能省略
+create table if not exists crawl_history (
+    id bigint not null auto_increment,
+    report_id varchar(64) not null,
+    task_id int not null,
+    done int not null default 0,
+    status_code int not null default 0,
+    final_url varchar(2048) not null default '',
+    content_type varchar(255) not null default '',
+    bytes bigint not null default 0,
+    latency bigint not null default 0,
+    error_class varchar(32) not null default '',
+    error_msg text not null,
+    page_key varchar(512) not null default '',
+    data_key varchar(512) not null default '',
+    fetch_time bigint not null default 0,
+    content_hash varchar(64) not null default '',
+    simhash bigint unsigned not null default 0,
+    unchanged tinyint(1) not null default 0,
+    near_duplicate tinyint(1) not null default 0,
+    create_time datetime not null,
+    primary key (id),
+    unique key uk_report_id (report_id),
+    key idx_task_id (task_id, id)
+) engine=InnoDB default charset=utf8mb4;
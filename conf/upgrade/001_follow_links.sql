@@ -0,0 +1,6 @@
+-- 跟随页面中的链接：规则和任务增加follow_links
+alter table crawl_rules
+    add column follow_links tinyint(1) not null default 0;
+
+alter table crawl_tasks
+    add column follow_links tinyint(1) not null default 0;
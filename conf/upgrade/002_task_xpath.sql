@@ -0,0 +1,10 @@
+-- 任务保存规则的xpath，用于抽取字段；xpath读取为string，不能为NULL
+update crawl_rules set xpath='' where xpath is null;
+
+alter table crawl_rules
+    modify xpath text not null;
+
+alter table crawl_tasks
+    add column xpath text not null;
+
+update crawl_tasks set xpath='' where xpath is null;
@@ -0,0 +1,4 @@
+-- 任务记录最近一次保存的页面和抽取结果的key
+alter table crawl_tasks
+    add column page_key varchar(512) not null default '',
+    add column data_key varchar(512) not null default '';
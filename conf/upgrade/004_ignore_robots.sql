@@ -0,0 +1,6 @@
+-- 已获站点许可的规则和任务可以不遵守robots.txt
+alter table crawl_rules
+    add column ignore_robots tinyint(1) not null default 0;
+
+alter table crawl_tasks
+    add column ignore_robots tinyint(1) not null default 0;
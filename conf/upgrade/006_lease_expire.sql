@@ -0,0 +1,3 @@
+-- 分发后的租约到期时间，到期未报告的任务重新等待调度
+alter table crawl_tasks
+    add column lease_expire bigint not null default 0;
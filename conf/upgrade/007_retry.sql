@@ -0,0 +1,5 @@
+-- 失败的任务按指数退避重试
+alter table crawl_tasks
+    add column retry_times int not null default 0,
+    add column next_retry_time bigint not null default 0,
+    add key idx_status (status, next_retry_time);
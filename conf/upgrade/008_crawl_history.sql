@@ -0,0 +1,18 @@
+-- 每次抓取的报告
+create table if not exists crawl_history (
+    id bigint not null auto_increment,
+    task_id int not null,
+    done int not null default 0,
+    status_code int not null default 0,
+    final_url varchar(2048) not null default '',
+    content_type varchar(255) not null default '',
+    bytes bigint not null default 0,
+    latency bigint not null default 0,
+    error_class varchar(32) not null default '',
+    error_msg text not null,
+    page_key varchar(512) not null default '',
+    data_key varchar(512) not null default '',
+    fetch_time bigint not null default 0,
+    create_time datetime not null,
+    primary key (id)
+) engine=InnoDB default charset=utf8mb4;
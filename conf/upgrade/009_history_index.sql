@@ -0,0 +1,3 @@
+-- 按任务倒序查询抓取历史
+alter table crawl_history
+    add key idx_task_id (task_id, id);
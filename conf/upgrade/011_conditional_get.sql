@@ -0,0 +1,4 @@
+-- 周期任务重抓时用于条件请求
+alter table crawl_tasks
+    add column etag varchar(255) not null default '',
+    add column last_modified varchar(64) not null default '';
@@ -0,0 +1,19 @@
+-- 页面指纹：内容hash和SimHash，SimHash按16位切成4段分别索引，用于查找镜像站点
+alter table crawl_tasks
+    add column content_hash varchar(64) not null default '',
+    add column simhash bigint unsigned not null default 0,
+    add column simhash_band0 smallint unsigned not null default 0,
+    add column simhash_band1 smallint unsigned not null default 0,
+    add column simhash_band2 smallint unsigned not null default 0,
+    add column simhash_band3 smallint unsigned not null default 0,
+    add column duplicate_of int not null default 0,
+    add key idx_simhash_band0 (simhash_band0),
+    add key idx_simhash_band1 (simhash_band1),
+    add key idx_simhash_band2 (simhash_band2),
+    add key idx_simhash_band3 (simhash_band3);
+
+alter table crawl_history
+    add column content_hash varchar(64) not null default '',
+    add column simhash bigint unsigned not null default 0,
+    add column unchanged tinyint(1) not null default 0,
+    add column near_duplicate tinyint(1) not null default 0;
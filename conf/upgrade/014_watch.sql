@@ -0,0 +1,8 @@
+-- 页面变化监测方式和通知地址
+alter table crawl_rules
+    add column watch int not null default 0,
+    add column webhook varchar(1024) not null default '';
+
+alter table crawl_tasks
+    add column watch int not null default 0,
+    add column webhook varchar(1024) not null default '';
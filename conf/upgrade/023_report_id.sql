@@ -0,0 +1,9 @@
+-- fetcher重复投递的报告按report_id去重，唯一索引不能省略；已有的记录用id生成report_id
+alter table crawl_history
+    add column report_id varchar(64) after id;
+
+update crawl_history set report_id=concat('legacy-', id);
+
+alter table crawl_history
+    modify report_id varchar(64) not null,
+    add unique key uk_report_id (report_id);
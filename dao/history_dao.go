@@ -0,0 +1,111 @@
+package dao
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+const (
+	HistoryTable = "crawl_history"
+)
+
+//report_id上有唯一索引，重复投递的报告插入时返回该错误
+var ErrDuplicateReport = errors.New("duplicate report")
+
+type HistoryDao struct {
+	db *sqlx.DB
+}
+
+func InitHistoryDao(db *sqlx.DB) *HistoryDao {
+	return &HistoryDao{db: db}
+}
+
+/*
+	记录一次抓取结果，report_id已存在时返回ErrDuplicateReport
+*/
+func (this *HistoryDao) AddHistory(history types.CrawlHistory) (int64, error) {
+	sqlStr := fmt.Sprintf("insert into %s (report_id, task_id, done, status_code, final_url, content_type, bytes, latency, error_class, error_msg, page_key, data_key, fetch_time, content_hash, simhash, unchanged, near_duplicate, create_time) values (:report_id, :task_id, :done, :status_code, :final_url, :content_type, :bytes, :latency, :error_class, :error_msg, :page_key, :data_key, :fetch_time, :content_hash, :simhash, :unchanged, :near_duplicate, :create_time)", HistoryTable)
+	result, err := this.db.NamedExec(sqlStr, history)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		return 0, ErrDuplicateReport
+	}
+	if err != nil {
+		log.Errorln("add crawl history error: ", err, " data:", history)
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+/*
+	检查report_id上是否有唯一索引，没有则无法忽略重复投递的报告，表结构见conf/schema.sql
+*/
+func (this *HistoryDao) HasReportIndex() (bool, error) {
+	var count int
+	sqlStr := fmt.Sprintf("select count(*) from information_schema.statistics where table_schema=database() and table_name='%s' and column_name='report_id' and non_unique=0", HistoryTable)
+	err := this.db.Get(&count, sqlStr)
+	if err != nil {
+		log.Errorln("check report_id index of ", HistoryTable, " error: ", err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+/*
+	删除报告对应的抓取记录，报告未能处理完时使用，使重新投递的报告可以再次处理
+*/
+func (this *HistoryDao) DeleteReport(reportId string) error {
+	sqlStr := fmt.Sprintf("delete from %s where report_id=?", HistoryTable)
+	_, err := this.db.Exec(sqlStr, reportId)
+	if err != nil {
+		log.Errorln("delete crawl history of report ", reportId, " error: ", err)
+	}
+	return err
+}
+
+/*
+	按时间倒序分页获取任务的抓取记录
+*/
+func (this *HistoryDao) GetTaskHistory(taskId int32, offset int, limit int) ([]types.CrawlHistory, error) {
+	histories := []types.CrawlHistory{}
+	sqlStr := fmt.Sprintf("select * from %s where task_id=? order by id desc limit %d, %d", HistoryTable, offset, limit)
+	err := this.db.Select(&histories, sqlStr, taskId)
+	if err != nil {
+		log.Errorln("get history of task ", taskId, " error: ", err)
+	}
+	return histories, err
+}
+
+/*
+	任务最近一次成功的抓取记录，没有则返回nil
+*/
+func (this *HistoryDao) GetLastSuccess(taskId int32) (*types.CrawlHistory, error) {
+	history := types.CrawlHistory{}
+	sqlStr := fmt.Sprintf("select * from %s where task_id=? and done=%d order by id desc limit 1", HistoryTable, types.FETCH_DONE)
+	err := this.db.Get(&history, sqlStr, taskId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorln("get last success of task ", taskId, " error: ", err)
+		return nil, err
+	}
+	return &history, nil
+}
+
+/*
+	id为sinceId的记录之后失败的次数
+*/
+func (this *HistoryDao) CountFailuresSince(taskId int32, sinceId int64) (int64, error) {
+	var count int64
+	sqlStr := fmt.Sprintf("select count(*) from %s where task_id=? and id>? and done!=%d", HistoryTable, types.FETCH_DONE)
+	err := this.db.Get(&count, sqlStr, taskId, sinceId)
+	if err != nil {
+		log.Errorln("count failures of task ", taskId, " error: ", err)
+	}
+	return count, err
+}
@@ -7,10 +7,15 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/lib"
 	"github.com/zhaozhi406/crawler/types"
+	"strings"
 	"time"
 )
 
+//按SimHash的每一段最多取出的候选任务数
+const maxDuplicateCandidates = 1000
+
 type TaskDao struct {
 	db *sqlx.DB
 }
@@ -23,12 +28,19 @@ const (
 	TaskTable = "crawl_tasks"
 )
 
+//crawl_tasks中domain和urlpath的最大长度（字符数），超过的链接无法保存
+const (
+	TaskDomainMaxLen  = 191
+	TaskUrlpathMaxLen = 512
+)
+
 const (
 	TASK_CANCELED TaskStatus = -1 + iota
 	TASK_WAITING
 	TASK_CRAWLING
 	TASK_FINISH
 	TASK_FAILED
+	TASK_DENIED //被robots.txt禁止
 )
 
 const (
@@ -68,7 +80,7 @@ func (this *TaskDao) AddNewTasks(tasks []types.CrawlTask) (int64, []sql.Result,
 
 	results := make([]sql.Result, len(tasks))
 	var affectedRows int64 = 0
-	sqlStr := fmt.Sprintf("insert into %s (domain, urlpath, priority, cycle, status, last_crawl_time, crawl_times, create_time, update_time) values (:domain, :urlpath, :priority, :cycle, :status, :last_crawl_time, :crawl_times, :create_time, :update_time) on duplicate key update priority=values(priority), cycle=values(cycle), update_time=values(update_time) ", TaskTable)
+	sqlStr := fmt.Sprintf("insert into %s (domain, urlpath, xpath, watch, webhook, priority, cycle, status, last_crawl_time, crawl_times, follow_links, ignore_robots, create_time, update_time) values (:domain, :urlpath, :xpath, :watch, :webhook, :priority, :cycle, :status, :last_crawl_time, :crawl_times, :follow_links, :ignore_robots, :create_time, :update_time) on duplicate key update priority=values(priority), cycle=values(cycle), update_time=values(update_time) ", TaskTable)
 	for i, task := range tasks {
 		result, err1 := tx.NamedExec(sqlStr, task)
 		results[i] = result
@@ -84,6 +96,34 @@ func (this *TaskDao) AddNewTasks(tasks []types.CrawlTask) (int64, []sql.Result,
 	return affectedRows, results, err
 }
 
+/*
+	添加从页面链接发现的任务，已存在的任务保持不变（不覆盖种子任务的优先级和周期）；返回新增的任务数
+	domain和urlpath的长度需要调用方按TaskDomainMaxLen, TaskUrlpathMaxLen先过滤，其他错误（如截断）照常返回
+*/
+func (this *TaskDao) AddLinkTasks(tasks []types.CrawlTask) (int64, error) {
+	tx, err := this.db.Beginx()
+	if err != nil {
+		log.Errorln("begin transaction error:", err)
+		return 0, err
+	}
+
+	var affectedRows int64 = 0
+	//只在唯一键冲突时保持原记录不变，此时影响行数为0
+	sqlStr := fmt.Sprintf("insert into %s (domain, urlpath, xpath, watch, webhook, priority, cycle, status, last_crawl_time, crawl_times, follow_links, ignore_robots, create_time, update_time) values (:domain, :urlpath, :xpath, :watch, :webhook, :priority, :cycle, :status, :last_crawl_time, :crawl_times, :follow_links, :ignore_robots, :create_time, :update_time) on duplicate key update id=id", TaskTable)
+	for _, task := range tasks {
+		result, err := tx.NamedExec(sqlStr, task)
+		if err != nil {
+			log.Errorln("add link task error:", err, " data:", task)
+			tx.Rollback()
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		affectedRows += n
+	}
+	err = tx.Commit()
+	return affectedRows, err
+}
+
 /*
 	根据任务添加结果，修改rule的状态
 */
@@ -144,7 +184,7 @@ func (this *TaskDao) SetTasksStatus(tasks []types.CrawlTask, status TaskStatus)
 		}
 
 		if status == TASK_FINISH {
-			sqlStr = fmt.Sprintf("update %s set status=%d, last_crawl_time=%d, crawl_times=crawl_times+1, update_time='%s' where id in (?)", TaskTable, status, now.Unix(), now.Format("2006-01-02 15:04:05"))
+			sqlStr = fmt.Sprintf("update %s set status=%d, last_crawl_time=%d, crawl_times=crawl_times+1, retry_times=0, next_retry_time=0, update_time='%s' where id in (?)", TaskTable, status, now.Unix(), now.Format("2006-01-02 15:04:05"))
 		} else {
 			sqlStr = fmt.Sprintf("update %s set status=%d, update_time='%s' where id in (?)", TaskTable, status, now.Format("2006-01-02 15:04:05"))
 		}
@@ -165,12 +205,184 @@ func (this *TaskDao) SetTasksStatus(tasks []types.CrawlTask, status TaskStatus)
 }
 
 /*
-	选取status为0, 或status=2且调度时间已到的任务
+	记录任务最近一次成功抓取返回的ETag和Last-Modified
+*/
+func (this *TaskDao) SetTaskValidators(id int32, etag string, lastModified string) (int64, error) {
+	sqlStr := fmt.Sprintf("update %s set etag=?, last_modified=? where id=?", TaskTable)
+	result, err := this.db.Exec(sqlStr, etag, lastModified, id)
+	if err != nil {
+		log.Errorln("set task ", id, " validators error: ", err)
+		return 0, err
+	}
+	affectedRows, _ := result.RowsAffected()
+	return affectedRows, nil
+}
+
+/*
+	记录任务最近一次抓取内容的指纹，以及内容近似的镜像任务
+*/
+func (this *TaskDao) SetTaskFingerprint(id int32, contentHash string, simhash uint64, duplicateOf int32) (int64, error) {
+	bands := lib.SimHashBandsOf(simhash)
+	sqlStr := fmt.Sprintf("update %s set content_hash=?, simhash=?, simhash_band0=?, simhash_band1=?, simhash_band2=?, simhash_band3=?, duplicate_of=? where id=?", TaskTable)
+	result, err := this.db.Exec(sqlStr, contentHash, simhash, bands[0], bands[1], bands[2], bands[3], duplicateOf, id)
+	if err != nil {
+		log.Errorln("set task ", id, " fingerprint error: ", err)
+		return 0, err
+	}
+	affectedRows, _ := result.RowsAffected()
+	return affectedRows, nil
+}
+
+/*
+	查找其他domain上SimHash距离不超过maxDistance的任务，没有则返回0；
+	只比较至少有一段SimHash相同的任务，maxDistance不超过lib.SimHashBands-1时结果是准确的
+*/
+func (this *TaskDao) FindNearDuplicate(id int32, domain string, simhash uint64, maxDistance int) (int32, error) {
+	if simhash == 0 {
+		return 0, nil
+	}
+	//距离不超过SimHashBands-1时至少有一段相同，只需比较按段索引查到的候选
+	bands := lib.SimHashBandsOf(simhash)
+	selects := []string{}
+	args := []interface{}{}
+	for i, band := range bands {
+		selects = append(selects, fmt.Sprintf("(select id, simhash from %s where simhash_band%d=? and id!=? and domain!=? and simhash!=0 limit %d)", TaskTable, i, maxDuplicateCandidates))
+		args = append(args, band, id, domain)
+	}
+	candidates := []struct {
+		Id      int32
+		Simhash uint64
+	}{}
+	err := this.db.Select(&candidates, strings.Join(selects, " union "), args...)
+	if err != nil {
+		log.Errorln("find near duplicate of task ", id, " error: ", err)
+		return 0, err
+	}
+	var dupId int32
+	for _, candidate := range candidates {
+		if lib.SimHashDistance(simhash, candidate.Simhash) <= maxDistance && (dupId == 0 || candidate.Id < dupId) {
+			dupId = candidate.Id
+		}
+	}
+	return dupId, nil
+}
+
+/*
+	分发任务时标记为抓取中，并设置租约到期时间；返回实际租出的任务
+*/
+func (this *TaskDao) LeaseTasks(taskIds []int32, leaseExpire int64) ([]int32, error) {
+	leased := []int32{}
+	if len(taskIds) == 0 {
+		return leased, ErrNoTasks
+	}
+	now := time.Now()
+	//逐个条件更新，只有仍在等待的任务（包括到期的周期任务）才能租出，多个scheduler或fetcher同时拉取时不会重复分配
+	sqlStr := fmt.Sprintf("update %s set status=%d, lease_expire=?, update_time=? where id=? and (status=%d or (status=%d and cycle>0 and cycle+last_crawl_time<=?))", TaskTable, TASK_CRAWLING, TASK_WAITING, TASK_FINISH)
+	for _, taskId := range taskIds {
+		result, err := this.db.Exec(sqlStr, leaseExpire, now.Format("2006-01-02 15:04:05"), taskId, now.Unix())
+		if err != nil {
+			log.Errorln("lease task ", taskId, " error: ", err)
+			return leased, err
+		}
+		if affectedRows, _ := result.RowsAffected(); affectedRows == 1 {
+			leased = append(leased, taskId)
+		}
+	}
+	return leased, nil
+}
+
+/*
+	fetcher未接收的任务，放回等待队列
+*/
+func (this *TaskDao) ReleaseTasks(taskIds []int32) (int64, error) {
+	if len(taskIds) == 0 {
+		return 0, ErrNoTasks
+	}
+	now := time.Now()
+	sqlTmp := fmt.Sprintf("update %s set status=%d, lease_expire=0, update_time='%s' where status=%d and id in (?)", TaskTable, TASK_WAITING, now.Format("2006-01-02 15:04:05"), TASK_CRAWLING)
+	return this.execIn(sqlTmp, taskIds)
+}
+
+/*
+	租约已过期仍未报告结果的任务，重新置为等待
+*/
+func (this *TaskDao) ReclaimExpiredTasks() (int64, error) {
+	now := time.Now()
+	sqlStr := fmt.Sprintf("update %s set status=%d, lease_expire=0, update_time='%s' where status=%d and lease_expire<%d", TaskTable, TASK_WAITING, now.Format("2006-01-02 15:04:05"), TASK_CRAWLING, now.Unix())
+	result, err := this.db.Exec(sqlStr)
+	if err != nil {
+		log.Errorln("reclaim expired tasks error: ", err)
+		return 0, err
+	}
+	affectedRows, _ := result.RowsAffected()
+	return affectedRows, nil
+}
+
+func (this *TaskDao) execIn(sqlTmp string, taskIds []int32) (int64, error) {
+	sqlStr, args, err := sqlx.In(sqlTmp, taskIds)
+	if err != nil {
+		log.Errorln("make in sql error: ", err)
+		return 0, err
+	}
+	result, err := this.db.Exec(sqlStr, args...)
+	if err != nil {
+		log.Errorln("exec sql: ", sqlStr, " error: ", err)
+		return 0, err
+	}
+	affectedRows, _ := result.RowsAffected()
+	return affectedRows, nil
+}
+
+/*
+	记录任务最近一次抓取结果在PageStore中的key
+*/
+func (this *TaskDao) SetTaskPageKeys(id int32, pageKey string, dataKey string) (int64, error) {
+	sqlStr := fmt.Sprintf("update %s set page_key=?, data_key=? where id=?", TaskTable)
+	result, err := this.db.Exec(sqlStr, pageKey, dataKey, id)
+	if err != nil {
+		log.Errorln("set task ", id, " page keys error: ", err)
+		return 0, err
+	}
+	affectedRows, _ := result.RowsAffected()
+	return affectedRows, nil
+}
+
+/*
+	失败的任务重新等待调度，next_retry_time之前不会被选取
+*/
+func (this *TaskDao) SetTaskRetry(id int32, nextRetryTime int64) (int64, error) {
+	now := time.Now()
+	sqlStr := fmt.Sprintf("update %s set status=%d, retry_times=retry_times+1, next_retry_time=%d, update_time='%s' where id=?", TaskTable, TASK_WAITING, nextRetryTime, now.Format("2006-01-02 15:04:05"))
+	result, err := this.db.Exec(sqlStr, id)
+	if err != nil {
+		log.Errorln("set task ", id, " retry error: ", err)
+		return 0, err
+	}
+	affectedRows, _ := result.RowsAffected()
+	return affectedRows, nil
+}
+
+/*
+	分页获取重试次数用完、最终失败的任务
+*/
+func (this *TaskDao) GetFailedTasks(offset int, limit int) ([]types.CrawlTask, error) {
+	crawlTasks := []types.CrawlTask{}
+	sqlStr := fmt.Sprintf("select * from %s where status=%d order by update_time desc limit %d, %d", TaskTable, TASK_FAILED, offset, limit)
+	err := this.db.Select(&crawlTasks, sqlStr)
+	if err != nil {
+		log.Errorln(err)
+	}
+	return crawlTasks, err
+}
+
+/*
+	选取status为0且已到重试时间, 或status=2的周期任务且调度时间已到的任务；条件需和LeaseTasks一致
 */
 func (this *TaskDao) GetWaitingTasks() ([]types.CrawlTask, error) {
 	crawlTasks := []types.CrawlTask{}
 
-	sqlStr := fmt.Sprintf("select * from %s where status=%d or (status=%d and cycle+last_crawl_time <= %d)", TaskTable, TASK_WAITING, TASK_FINISH, time.Now().Unix())
+	now := time.Now().Unix()
+	sqlStr := fmt.Sprintf("select * from %s where (status=%d and next_retry_time <= %d) or (status=%d and cycle>0 and cycle+last_crawl_time <= %d)", TaskTable, TASK_WAITING, now, TASK_FINISH, now)
 
 	err := this.db.Select(&crawlTasks, sqlStr)
 	if err != nil {
@@ -179,11 +391,47 @@ func (this *TaskDao) GetWaitingTasks() ([]types.CrawlTask, error) {
 	return crawlTasks, err
 }
 
+/*
+	根据id获取任务
+*/
+func (this *TaskDao) GetTaskById(id int32) (types.CrawlTask, error) {
+	task := types.CrawlTask{}
+	sqlStr := fmt.Sprintf("select * from %s where id=?", TaskTable)
+	err := this.db.Get(&task, sqlStr, id)
+	if err != nil {
+		log.Errorln("get task ", id, " error: ", err)
+	}
+	return task, err
+}
+
+/*
+	根据domain和urlpath获取任务
+*/
+func (this *TaskDao) GetTaskByUrl(domain string, urlpath string) (types.CrawlTask, error) {
+	task := types.CrawlTask{}
+	sqlStr := fmt.Sprintf("select * from %s where domain=? and urlpath=?", TaskTable)
+	err := this.db.Get(&task, sqlStr, domain, urlpath)
+	if err != nil {
+		log.Errorln("get task ", domain, urlpath, " error: ", err)
+	}
+	return task, err
+}
+
 /*
 	规则转为任务
 */
 func (this *TaskDao) ConvertRuleToTask(rule types.CrawlRule) types.CrawlTask {
 	tm := time.Now()
-	task := types.CrawlTask{Domain: rule.Domain, Urlpath: rule.Urlpath, Priority: rule.Priority, Cycle: rule.Cycle, Status: 0, LastCrawlTime: 0, CrawlTimes: 0, CreateTime: tm, UpdateTime: tm}
+	task := types.CrawlTask{Domain: rule.Domain, Urlpath: rule.Urlpath, Xpath: rule.Xpath, Watch: rule.Watch, Webhook: rule.Webhook, Priority: rule.Priority, Cycle: rule.Cycle, Status: 0, LastCrawlTime: 0, CrawlTimes: 0, FollowLinks: rule.FollowLinks, IgnoreRobots: rule.IgnoreRobots, CreateTime: tm, UpdateTime: tm}
+	return task
+}
+
+/*
+	页面中发现的链接转为任务，优先级和周期继承自父任务；
+	新任务不再继续跟踪链接，避免无限扩散
+*/
+func (this *TaskDao) ConvertLinkToTask(parent types.CrawlTask, domain string, urlpath string) types.CrawlTask {
+	tm := time.Now()
+	task := types.CrawlTask{Domain: domain, Urlpath: urlpath, Priority: parent.Priority, Cycle: parent.Cycle, Status: 0, LastCrawlTime: 0, CrawlTimes: 0, FollowLinks: false, CreateTime: tm, UpdateTime: tm}
 	return task
 }
@@ -0,0 +1,66 @@
+package fetcher
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//变化摘要中最多列出的行数
+const maxSummaryLines = 20
+
+//比较新旧页面的可见文本，返回变化摘要和是否有变化
+func DetectPageChange(oldPage []byte, newPage []byte) (types.ChangeSummary, bool) {
+	added, removed := lib.DiffLines(lib.PageTexts(oldPage), lib.PageTexts(newPage))
+	summary := types.ChangeSummary{
+		Added:        len(added),
+		Removed:      len(removed),
+		AddedLines:   truncateLines(added),
+		RemovedLines: truncateLines(removed)}
+	return summary, len(added) > 0 || len(removed) > 0
+}
+
+//比较新旧两次xpath抽取的字段，返回变化摘要和是否有变化
+func DetectFieldChange(oldFields map[string][]string, newFields map[string][]string) (types.ChangeSummary, bool) {
+	summary := types.ChangeSummary{Fields: map[string]types.FieldChange{}}
+	names := map[string]bool{}
+	for name := range oldFields {
+		names[name] = true
+	}
+	for name := range newFields {
+		names[name] = true
+	}
+	sortedNames := []string{}
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	allAdded := []string{}
+	allRemoved := []string{}
+	for _, name := range sortedNames {
+		oldValues := oldFields[name]
+		newValues := newFields[name]
+		if reflect.DeepEqual(oldValues, newValues) {
+			continue
+		}
+		summary.Fields[name] = types.FieldChange{Old: oldValues, New: newValues}
+		added, removed := lib.DiffLines(oldValues, newValues)
+		allAdded = append(allAdded, added...)
+		allRemoved = append(allRemoved, removed...)
+	}
+	summary.Added = len(allAdded)
+	summary.Removed = len(allRemoved)
+	summary.AddedLines = truncateLines(allAdded)
+	summary.RemovedLines = truncateLines(allRemoved)
+	return summary, len(summary.Fields) > 0
+}
+
+func truncateLines(lines []string) []string {
+	if len(lines) > maxSummaryLines {
+		return lines[:maxSummaryLines]
+	}
+	return lines
+}
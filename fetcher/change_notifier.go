@@ -0,0 +1,208 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//投递的累计指标，通过fetcher的/debug/vars输出
+var notifierMetrics = expvar.NewMap("change_notifier")
+
+//待投递的变化事件，持久化在jsonLog中
+type pendingEvent struct {
+	Webhook  string          `json:"webhook"`
+	Event    json.RawMessage `json:"event"`
+	id       string
+	attempts int
+	nextTime time.Time
+}
+
+//把页面变化事件post给webhook，失败后按指数退避重试，直到成功；
+//待投递的事件写入本地文件，重启后继续投递。Notify不会阻塞，积压的事件超过maxPending时丢弃新事件
+type ChangeNotifier struct {
+	httpClient     *lib.HttpClient
+	defaultWebhook string
+	log            *jsonLog
+	maxPending     int
+	retryBase      time.Duration
+	retryMax       time.Duration
+	lock           sync.Mutex
+	events         []*pendingEvent //按写入顺序
+	notify         chan bool
+	quitChan       chan bool
+	doneChan       chan bool
+}
+
+//path为保存待投递事件的文件，为空时只保存在内存中
+func InitChangeNotifier(httpClient *lib.HttpClient, defaultWebhook string, path string, maxPending int, retryBase time.Duration, retryMax time.Duration) (*ChangeNotifier, error) {
+	if retryBase <= 0 {
+		retryBase = time.Second
+	}
+	if retryMax < retryBase {
+		retryMax = retryBase
+	}
+	jl, err := openJsonLog(path)
+	if err != nil {
+		return nil, err
+	}
+	notifier := &ChangeNotifier{
+		httpClient:     httpClient,
+		defaultWebhook: defaultWebhook,
+		log:            jl,
+		maxPending:     maxPending,
+		retryBase:      retryBase,
+		retryMax:       retryMax,
+		notify:         make(chan bool, 1),
+		quitChan:       make(chan bool),
+		doneChan:       make(chan bool)}
+	//重放的事件立即重新投递
+	ids, items := jl.Items()
+	for i, data := range items {
+		pending := &pendingEvent{}
+		if json.Unmarshal(data, pending) == nil {
+			pending.id = ids[i]
+			notifier.events = append(notifier.events, pending)
+		}
+	}
+	if len(notifier.events) > 0 {
+		log.Warnln("replay ", len(notifier.events), " undelivered change events from ", path)
+	}
+	return notifier, nil
+}
+
+//webhook为空时使用默认地址，都没有则丢弃事件
+func (this *ChangeNotifier) Notify(webhook string, event types.ChangeEvent) {
+	if webhook == "" {
+		webhook = this.defaultWebhook
+	}
+	if webhook == "" {
+		log.Warnln("no webhook for change of task ", event.TaskId, ", drop it.")
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Errorln("make change event json error: ", err)
+		return
+	}
+	pending := &pendingEvent{Webhook: webhook, Event: body, id: newLogId()}
+
+	this.lock.Lock()
+	if this.maxPending > 0 && len(this.events) >= this.maxPending {
+		this.lock.Unlock()
+		notifierMetrics.Add("dropped", 1)
+		log.Warnln(this.maxPending, " change events are waiting, drop event to ", webhook, ": ", string(body))
+		return
+	}
+	err = this.log.Add([]string{pending.id}, []interface{}{pending})
+	if err == nil {
+		this.events = append(this.events, pending)
+	}
+	this.lock.Unlock()
+	if err != nil {
+		notifierMetrics.Add("dropped", 1)
+		log.Errorln("save change event error: ", err, ", drop event to ", webhook)
+		return
+	}
+	select {
+	case this.notify <- true:
+	default:
+	}
+}
+
+//待投递的事件数
+func (this *ChangeNotifier) Pending() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.events)
+}
+
+func (this *ChangeNotifier) Run() {
+	defer close(this.doneChan)
+	for {
+		pending, wait := this.next(time.Now())
+		if pending != nil {
+			this.deliver(pending)
+			continue
+		}
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timeout = time.After(wait)
+		}
+		select {
+		case <-this.notify:
+		case <-timeout:
+		case <-this.quitChan:
+			return
+		}
+	}
+}
+
+//停止投递，未投递的事件留在文件中，下次启动时继续投递
+func (this *ChangeNotifier) Stop() {
+	close(this.quitChan)
+	<-this.doneChan
+	if n := this.Pending(); n > 0 {
+		log.Warnln(n, " change events are not delivered.")
+	}
+	this.log.Close()
+}
+
+//返回到期的事件；没有时返回到最早的事件到期的等待时间，没有事件时为0
+func (this *ChangeNotifier) next(now time.Time) (*pendingEvent, time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var wait time.Duration
+	for _, pending := range this.events {
+		if !pending.nextTime.After(now) {
+			return pending, 0
+		}
+		if d := pending.nextTime.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+func (this *ChangeNotifier) deliver(pending *pendingEvent) {
+	pending.attempts++
+	status, res, err := this.httpClient.PostJsonStatus(pending.Webhook, pending.Event)
+	if err == nil && status >= 200 && status < 300 {
+		log.Infoln("deliver change event to ", pending.Webhook, " done.")
+		notifierMetrics.Add("delivered", 1)
+		this.remove(pending)
+		return
+	}
+	notifierMetrics.Add("failed", 1)
+	delay := this.retryBase
+	for i := 1; i < pending.attempts && delay < this.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > this.retryMax {
+		delay = this.retryMax
+	}
+	log.Warnln("deliver change event to ", pending.Webhook, " failed, status: ", status, ", error: ", err, ", response: ", string(res), ", retry after ", delay)
+	this.lock.Lock()
+	pending.nextTime = time.Now().Add(delay)
+	this.lock.Unlock()
+}
+
+func (this *ChangeNotifier) remove(pending *pendingEvent) {
+	this.lock.Lock()
+	for i, event := range this.events {
+		if event == pending {
+			this.events = append(this.events[:i], this.events[i+1:]...)
+			break
+		}
+	}
+	this.lock.Unlock()
+	err := this.log.Done(pending.id)
+	if err != nil {
+		log.Errorln("save change event state error: ", err)
+	}
+}
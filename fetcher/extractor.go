@@ -0,0 +1,52 @@
+package fetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/antchfx/htmlquery"
+	"github.com/antchfx/xpath"
+)
+
+//未命名的xpath表达式抽取结果使用的字段名
+const DefaultFieldName = "value"
+
+//按规则中的xpath从页面抽取字段；
+//expr可以是单个xpath表达式，也可以是{"字段名": "xpath"}形式的json
+func ExtractFields(page []byte, expr string) (map[string][]string, error) {
+	exprs, err := parseXpathExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := htmlquery.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string][]string{}
+	for name, e := range exprs {
+		compiled, err := xpath.Compile(e)
+		if err != nil {
+			return nil, err
+		}
+		values := []string{}
+		for _, node := range htmlquery.QuerySelectorAll(doc, compiled) {
+			values = append(values, strings.TrimSpace(htmlquery.InnerText(node)))
+		}
+		fields[name] = values
+	}
+	return fields, nil
+}
+
+func parseXpathExpr(expr string) (map[string]string, error) {
+	expr = strings.TrimSpace(expr)
+	exprs := map[string]string{}
+	if strings.HasPrefix(expr, "{") {
+		err := json.Unmarshal([]byte(expr), &exprs)
+		return exprs, err
+	}
+	exprs[DefaultFieldName] = expr
+	return exprs, nil
+}
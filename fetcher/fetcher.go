@@ -2,12 +2,15 @@ package fetcher
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	log "github.com/kdar/factorlog"
+	"github.com/mediocregopher/radix.v2/pool"
 	"github.com/zhaozhi406/crawler/lib"
 	"github.com/zhaozhi406/crawler/types"
 	"github.com/zhaozhi406/crawler/utils"
 	"net/http"
+	"net/url"
 	"strconv"
 	"sync"
 	"time"
@@ -22,12 +25,31 @@ type Fetcher struct {
 	scheduler_addr string
 	scheduler_api  map[string]string
 	pageStore      PageStore
+	robotsCache    *lib.RobotsCache
+	httpClient     *lib.HttpClient
+	notifier       *ChangeNotifier
+	sweeper        *PageSweeper
+	taskMode       string
+	advertiseAddr  string
+	pullBatch      int
+	pullInterval   time.Duration
+	redisQueue     *lib.RedisTaskQueue
+	queueName      string
+	inflight       map[int32][]byte //redis模式下已取出未完成的任务，用于处理完后删除
+	inflightLock   sync.Mutex
+	journal        *TaskJournal
+	replayTasks    []types.TaskPack //启动时从journal恢复的任务
+	graceful       bool             //退出时等待抓取中的任务完成，并把未开始的任务交还scheduler
+	outbox         *ReportOutbox
+	beatInterval   time.Duration //向scheduler发送心跳的间隔
 }
 
 const ErrOk = 0
 const (
 	ErrDataError = 1000 + iota
 	ErrInputError
+	ErrNotFound
+	ErrShuttingDown
 )
 
 var (
@@ -46,7 +68,55 @@ func InitFetcher(config map[string]string) *Fetcher {
 	queue := make(chan types.TaskPack, taskQueueSize)
 	wg := &sync.WaitGroup{}
 	quitChan := make(chan bool, 1)
-	pageStore := initPageStore(config)
+	httpClient := lib.InitHttpClient(config)
+	pageStore := initPageStore(config, httpClient)
+	robotsTtl, err := strconv.Atoi(config["robots_ttl"])
+	if err != nil {
+		robotsTtl = 86400
+	}
+	robotsAgent := config["robots_user_agent"]
+	if robotsAgent == "" {
+		robotsAgent = config["user_agent"]
+	}
+	robotsCache := lib.InitRobotsCache(httpClient, robotsAgent, time.Duration(robotsTtl)*time.Second)
+	notifier := initChangeNotifier(config, httpClient)
+	sweeper := initPageSweeper(config, pageStore)
+	taskMode := config["task_mode"]
+	var redisQueue *lib.RedisTaskQueue
+	if taskMode == TASK_MODE_REDIS {
+		redisPoolSize, _ := strconv.Atoi(config["redis_pool_size"])
+		redisPool, err := pool.New("tcp", config["redis_addr"], redisPoolSize)
+		if err != nil {
+			log.Errorln("init redis pool error: ", err, ", receive pushed tasks instead.")
+			taskMode = TASK_MODE_PUSH
+		} else {
+			redisQueue = lib.InitRedisTaskQueue(redisPool, config["task_queue_prefix"])
+		}
+	} else if taskMode != TASK_MODE_PULL {
+		taskMode = TASK_MODE_PUSH
+	}
+	//redis模式下processing list已经保证任务不丢失，不需要journal
+	var journal *TaskJournal
+	var replayTasks []types.TaskPack
+	if journalPath := config["task_journal"]; journalPath != "" && taskMode != TASK_MODE_REDIS {
+		journal, replayTasks, err = InitTaskJournal(journalPath)
+		if err != nil {
+			log.Errorln("open task journal ", journalPath, " error: ", err)
+			journal = nil
+		} else if len(replayTasks) > 0 {
+			log.Warnln("replay ", len(replayTasks), " unfinished tasks from journal ", journalPath)
+		}
+	}
+	advertise := advertiseAddr(config)
+	queueName := config["task_queue"]
+	if queueName == "" {
+		queueName = advertise
+	}
+	outbox := initReportOutbox(config, httpClient, fmt.Sprintf("http://%s%s", scheduler_addr, scheduler_api["report"]))
+	pullBatch, err := strconv.Atoi(config["pull_batch"])
+	if err != nil || pullBatch <= 0 {
+		pullBatch = taskQueueSize
+	}
 
 	return &Fetcher{
 		addr:           addr,
@@ -56,42 +126,208 @@ func InitFetcher(config map[string]string) *Fetcher {
 		quitChan:       quitChan,
 		scheduler_addr: scheduler_addr,
 		scheduler_api:  scheduler_api,
-		pageStore:      pageStore}
+		pageStore:      pageStore,
+		robotsCache:    robotsCache,
+		httpClient:     httpClient,
+		notifier:       notifier,
+		sweeper:        sweeper,
+		taskMode:       taskMode,
+		advertiseAddr:  advertise,
+		pullBatch:      pullBatch,
+		pullInterval:   configDuration(config, "pull_interval", time.Second),
+		redisQueue:     redisQueue,
+		queueName:      queueName,
+		inflight:       map[int32][]byte{},
+		journal:        journal,
+		replayTasks:    replayTasks,
+		graceful:       config["graceful_shutdown"] != "false",
+		outbox:         outbox,
+		beatInterval:   configDuration(config, "heartbeat_interval", 10*time.Second)}
+}
+
+//report_outbox为保存待发送报告的文件，不填或打开失败时只保存在内存中；
+//report_batch_size为每次最多发送的报告数，report_retry_base/report_retry_max为发送失败后重试的初始/最大间隔（秒）
+func initReportOutbox(config map[string]string, httpClient *lib.HttpClient, reportUrl string) *ReportOutbox {
+	batchSize, err := strconv.Atoi(config["report_batch_size"])
+	if err != nil {
+		batchSize = 50
+	}
+	retryBase := configDuration(config, "report_retry_base", time.Second)
+	retryMax := configDuration(config, "report_retry_max", time.Minute)
+	path := config["report_outbox"]
+	outbox, err := InitReportOutbox(path, httpClient, reportUrl, batchSize, retryBase, retryMax)
+	if err != nil {
+		log.Errorln("open report outbox ", path, " error: ", err, ", keep reports in memory instead.")
+		outbox, _ = InitReportOutbox("", httpClient, reportUrl, batchSize, retryBase, retryMax)
+	}
+	return outbox
 }
 
-func initPageStore(config map[string]string) PageStore {
+//retention_keep_versions: 每个页面保留的版本数，retention_max_days: 保留多少天内的版本，
+//都不配置时不清理；retention_sweep_period为清理间隔（秒）
+func initPageSweeper(config map[string]string, pageStore PageStore) *PageSweeper {
+	keepVersions, _ := strconv.Atoi(config["retention_keep_versions"])
+	maxDays, _ := strconv.Atoi(config["retention_max_days"])
+	if keepVersions <= 0 && maxDays <= 0 {
+		return nil
+	}
+	store, ok := pageStore.(sweepablePageStore)
+	if !ok {
+		log.Warnln("page store does not support retention, ignore retention config.")
+		return nil
+	}
+	period, err := strconv.Atoi(config["retention_sweep_period"])
+	if err != nil || period <= 0 {
+		period = 3600
+	}
+	return InitPageSweeper(store, keepVersions, time.Duration(maxDays)*24*time.Hour, time.Duration(period)*time.Second)
+}
+
+//change_webhook为规则未指定webhook时的默认地址，change_outbox为保存待投递事件的文件，
+//change_queue_size为最多积压的事件数，change_retry_base/change_retry_max为投递失败后重试的初始/最大间隔（秒）
+func initChangeNotifier(config map[string]string, httpClient *lib.HttpClient) *ChangeNotifier {
+	queueSize, err := strconv.Atoi(config["change_queue_size"])
+	if err != nil {
+		queueSize = 1000
+	}
+	retryBase, err := strconv.Atoi(config["change_retry_base"])
+	if err != nil {
+		retryBase = 5
+	}
+	retryMax, err := strconv.Atoi(config["change_retry_max"])
+	if err != nil {
+		retryMax = 600
+	}
+	path := config["change_outbox"]
+	notifier, err := InitChangeNotifier(httpClient, config["change_webhook"], path, queueSize, time.Duration(retryBase)*time.Second, time.Duration(retryMax)*time.Second)
+	if err != nil {
+		log.Errorln("open change event outbox ", path, " error: ", err, ", keep events in memory instead.")
+		notifier, _ = InitChangeNotifier(httpClient, config["change_webhook"], "", queueSize, time.Duration(retryBase)*time.Second, time.Duration(retryMax)*time.Second)
+	}
+	return notifier
+}
+
+func initPageStore(config map[string]string, httpClient *lib.HttpClient) PageStore {
 	localDir := config["local_dir"]
 	weedfsMaster := config["weedfs_master"]
+	if warcDir := config["warc_dir"]; warcDir != "" {
+		maxSize, err := strconv.ParseInt(config["warc_max_size"], 10, 64)
+		if err != nil {
+			maxSize = 1 << 30
+		}
+		store, err := InitWarcPageStore(warcDir, config["warc_prefix"], maxSize)
+		if err == nil {
+			return store
+		}
+		log.Errorln("init warc page store in ", warcDir, " error: ", err)
+	}
+	if bucket := config["s3_bucket"]; bucket != "" {
+		threshold, _ := strconv.ParseInt(config["s3_multipart_threshold"], 10, 64)
+		partSize, _ := strconv.ParseInt(config["s3_part_size"], 10, 64)
+		s3Config := S3Config{
+			Endpoint:           config["s3_endpoint"],
+			Bucket:             bucket,
+			Region:             config["s3_region"],
+			AccessKey:          config["s3_access_key"],
+			SecretKey:          config["s3_secret_key"],
+			KeyTemplate:        config["s3_key_template"],
+			PathStyle:          config["s3_path_style"] != "false",
+			MultipartThreshold: threshold,
+			PartSize:           partSize}
+		store, err := InitS3PageStore(s3Config, httpClient)
+		if err == nil {
+			return store
+		}
+		log.Errorln("init s3 page store error: ", err)
+	}
 	if localDir != "" {
-		return &LocalPageStore{dir: localDir}
+		if store := InitLocalPageStore(localDir, config["local_compression"]); store != nil {
+			return store
+		}
 	} else if weedfsMaster != "" {
-		return nil
+		return InitWeedPageStore(weedfsMaster, config["weedfs_collection"], config["weedfs_replication"], httpClient)
+	}
+	log.Warnln("does not specify a usable local dir or weedfs master! save pages to ./html_pages/")
+	if store := InitLocalPageStore("./html_pages", config["local_compression"]); store != nil {
+		return store
 	}
-	log.Warnln("does not specify local dir or weedfs master! save pages to ./html_pages/")
-	return &LocalPageStore{dir: "./html_pages"}
+	//目录无法创建时保存会失败，任务按失败重试
+	return &LocalPageStore{dir: "./html_pages", compression: lib.COMPRESSION_NONE}
 }
 
 //启动Fetcher
 func (this *Fetcher) Run() {
 	//启动api server
 	go this.httpService()
+	go this.notifier.Run()
+	go this.outbox.Run()
+	go this.heartbeat()
+	if this.sweeper != nil {
+		go this.sweeper.Run()
+	}
 	for i := 0; i < this.nWorkers; i++ {
 		this.wg.Add(1)
 		go this.fetchPage(this.pageStore)
 	}
 	log.Infoln("start ", this.nWorkers, " fetch workers...")
+	if len(this.replayTasks) > 0 {
+		//任务已在journal中，直接放入队列
+		go func(tasks []types.TaskPack) {
+			for _, pack := range tasks {
+				select {
+				case this.taskQueue <- pack:
+				case <-this.quitChan:
+					return
+				}
+			}
+		}(this.replayTasks)
+		this.replayTasks = nil
+	}
+	if this.taskMode == TASK_MODE_PULL {
+		go this.pullTasks()
+		log.Infoln("pull tasks from scheduler as ", this.advertiseAddr)
+	} else if this.taskMode == TASK_MODE_REDIS {
+		go this.consumeQueue()
+		log.Infoln("consume tasks from redis queue ", this.queueName)
+	}
 
 	go utils.HandleQuitSignal(func() {
 		close(this.quitChan)
 	})
 
+	//worker在当前任务完成后退出
 	this.wg.Wait()
+	if this.graceful {
+		this.handBackTasks()
+	}
+	this.outbox.Stop()
+	if this.journal != nil {
+		this.journal.Close()
+	}
+	this.notifier.Stop()
+	if this.sweeper != nil {
+		this.sweeper.Stop()
+	}
+}
+
+func (this *Fetcher) quitting() bool {
+	select {
+	case <-this.quitChan:
+		return true
+	default:
+		return false
+	}
 }
 
 func (this *Fetcher) httpService() {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/push/tasks", this.pushTasksHandler)
+	mux.HandleFunc("/status", this.statusHandler)
+	mux.HandleFunc("/page/versions", this.pageVersionsHandler)
+	mux.HandleFunc("/page/get", this.pageGetHandler)
+	mux.HandleFunc("/page/latest", this.pageLatestHandler)
+	mux.Handle("/debug/vars", expvar.Handler())
 	http.ListenAndServe(this.addr, mux)
 }
 
@@ -102,7 +338,10 @@ func (this *Fetcher) pushTasksHandler(w http.ResponseWriter, req *http.Request)
 	taskPacks := []types.TaskPack{}
 	var err error = nil
 	var result = types.JsonResult{}
-	if tasksJson != "" {
+	if this.quitting() {
+		result.Err = ErrShuttingDown
+		result.Msg = "fetcher is shutting down."
+	} else if tasksJson != "" {
 		err = json.Unmarshal([]byte(tasksJson), &taskPacks)
 		if err != nil {
 			msg := "Unmarshal task packs error: " + err.Error()
@@ -112,15 +351,9 @@ func (this *Fetcher) pushTasksHandler(w http.ResponseWriter, req *http.Request)
 		} else {
 			//添加任务到队列
 			//最多只允许执行1秒钟
-			timerChan := time.After(1 * time.Second)
-			cnt := 0
-			for _, pack := range taskPacks {
-				select {
-				case this.taskQueue <- pack:
-					cnt++
-				case <-timerChan:
-					break
-				}
+			cnt := this.enqueueTasks(taskPacks, time.After(1*time.Second))
+			if cnt < len(taskPacks) {
+				log.Warnln("task queue is full, accept ", cnt, " of ", len(taskPacks), " pushed tasks.")
 			}
 			result.Err = ErrOk
 			result.Data = taskPacks[:cnt] //将成功进入队列的任务返回
@@ -134,42 +367,281 @@ func (this *Fetcher) pushTasksHandler(w http.ResponseWriter, req *http.Request)
 	utils.OutputJsonResult(w, result)
 }
 
+//列出页面的所有版本，参数：domain, urlpath
+func (this *Fetcher) pageVersionsHandler(w http.ResponseWriter, req *http.Request) {
+	result := types.JsonResult{}
+	if _, err := utils.CheckHttpParams(req, map[string]string{"domain": "string", "urlpath": "string"}); err != nil {
+		result.Err = ErrInputError
+		result.Msg = err.Error()
+		utils.OutputJsonResult(w, result)
+		return
+	}
+	versions, err := this.pageStore.ListVersions(req.Form.Get("domain"), req.Form.Get("urlpath"))
+	if err != nil {
+		log.Errorln("list versions of ", req.Form.Get("domain"), req.Form.Get("urlpath"), " error: ", err)
+		result.Err = ErrDataError
+		result.Msg = err.Error()
+	} else {
+		result.Err = ErrOk
+		result.Data = versions
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//读取页面的指定版本，参数：domain, urlpath, version；成功时直接返回页面内容
+func (this *Fetcher) pageGetHandler(w http.ResponseWriter, req *http.Request) {
+	result := types.JsonResult{}
+	if _, err := utils.CheckHttpParams(req, map[string]string{"domain": "string", "urlpath": "string", "version": "int"}); err != nil {
+		result.Err = ErrInputError
+		result.Msg = err.Error()
+		utils.OutputJsonResult(w, result)
+		return
+	}
+	version, _ := strconv.ParseInt(req.Form.Get("version"), 10, 64)
+	page, err := this.pageStore.Get(req.Form.Get("domain"), req.Form.Get("urlpath"), version)
+	this.outputPage(w, version, page, err)
+}
+
+//读取页面的最新版本，参数：domain, urlpath；成功时直接返回页面内容
+func (this *Fetcher) pageLatestHandler(w http.ResponseWriter, req *http.Request) {
+	result := types.JsonResult{}
+	if _, err := utils.CheckHttpParams(req, map[string]string{"domain": "string", "urlpath": "string"}); err != nil {
+		result.Err = ErrInputError
+		result.Msg = err.Error()
+		utils.OutputJsonResult(w, result)
+		return
+	}
+	version, page, err := this.pageStore.Latest(req.Form.Get("domain"), req.Form.Get("urlpath"))
+	this.outputPage(w, version, page, err)
+}
+
+//页面保存前已转为utf-8，版本号放在X-Page-Version头中；出错时返回json
+func (this *Fetcher) outputPage(w http.ResponseWriter, version int64, page []byte, err error) {
+	if err != nil {
+		result := types.JsonResult{Err: ErrDataError, Msg: err.Error()}
+		if err == ErrPageNotFound {
+			result.Err = ErrNotFound
+		}
+		utils.OutputJsonResult(w, result)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Page-Version", strconv.FormatInt(version, 10))
+	w.Write(page)
+}
+
+//任务先写入journal再放入队列，返回放入队列的任务数；没能放入队列的从journal删除
+func (this *Fetcher) enqueueTasks(taskPacks []types.TaskPack, timeout <-chan time.Time) int {
+	if this.journal != nil {
+		err := this.journal.Add(taskPacks)
+		if err != nil {
+			log.Errorln("write task journal error: ", err)
+			return 0
+		}
+	}
+	cnt := 0
+loop:
+	for _, pack := range taskPacks {
+		select {
+		case this.taskQueue <- pack:
+			cnt++
+		case <-timeout:
+			break loop
+		}
+	}
+	if this.journal != nil && cnt < len(taskPacks) {
+		taskIds := []int32{}
+		for _, pack := range taskPacks[cnt:] {
+			taskIds = append(taskIds, pack.TaskId)
+		}
+		this.journal.Done(taskIds...)
+	}
+	return cnt
+}
+
+//任务已报告结果
+func (this *Fetcher) taskFinished(taskId int32) {
+	if this.journal != nil {
+		err := this.journal.Done(taskId)
+		if err != nil {
+			log.Errorln("write task journal error: ", err)
+		}
+	}
+	this.ackTask(taskId)
+}
+
+//退出时把队列中还未开始的任务交还：redis模式放回任务队列，其他模式通知scheduler释放租约；
+//交还失败的任务留在journal中，下次启动时重放
+func (this *Fetcher) handBackTasks() {
+	taskPacks := []types.TaskPack{}
+drain:
+	for {
+		select {
+		case pack := <-this.taskQueue:
+			taskPacks = append(taskPacks, pack)
+		default:
+			break drain
+		}
+	}
+	if len(taskPacks) == 0 {
+		return
+	}
+	if this.redisQueue != nil {
+		queueKey := this.redisQueue.QueueKey(this.queueName)
+		for _, pack := range taskPacks {
+			err := this.redisQueue.Push(queueKey, []types.TaskPack{pack})
+			if err != nil {
+				log.Errorln("hand back task ", pack.TaskId, " to ", queueKey, " error: ", err)
+				continue
+			}
+			this.ackTask(pack.TaskId)
+		}
+		log.Infoln("hand back ", len(taskPacks), " tasks to ", queueKey)
+		return
+	}
+
+	taskIds := []int32{}
+	for _, pack := range taskPacks {
+		taskIds = append(taskIds, pack.TaskId)
+	}
+	jsonBytes, _ := json.Marshal(taskIds)
+	releaseUrl := fmt.Sprintf("http://%s%s", this.scheduler_addr, this.scheduler_api["release"])
+	param := url.Values{}
+	param.Add("task_ids", string(jsonBytes))
+	res, err := this.httpClient.Post(releaseUrl, param)
+	result := types.JsonResult{}
+	if err == nil {
+		err = json.Unmarshal(res, &result)
+	}
+	if err != nil || result.Err != ErrOk {
+		log.Errorln("hand back ", len(taskIds), " tasks to scheduler failed, keep them in journal. error: ", err, ", response: ", string(res))
+		return
+	}
+	if this.journal != nil {
+		this.journal.Done(taskIds...)
+	}
+	log.Infoln("hand back ", len(taskIds), " tasks to scheduler.")
+}
+
 func (this *Fetcher) fetchPage(pageStore PageStore) {
 	defer this.wg.Done()
 
-	httpClient := lib.HttpClient{}
+	httpClient := this.httpClient
 loop:
 	for {
+		//退出时不再开始新的任务
+		if this.quitting() {
+			log.Infoln("quit fetch page...")
+			break
+		}
 		select {
 		case taskPack := <-this.taskQueue:
 			destUrl := taskPack.Domain + taskPack.Urlpath
-			html, err := httpClient.Get(destUrl)
+			report := types.FetchReport{TaskId: taskPack.TaskId, Done: types.FETCH_FAILED, FinalUrl: destUrl, FetchTime: time.Now().Unix()}
+			if !taskPack.IgnoreRobots {
+				allowed, err := this.robotsCache.Check(taskPack.Domain, taskPack.Urlpath)
+				if err != nil {
+					//robots.txt暂时无法获取，按失败报告，由scheduler稍后重试
+					log.Warnln("fetch '"+destUrl+"' postponed: ", err)
+					report.ErrorClass = types.ERR_CLASS_ROBOTS_ERROR
+					report.ErrorMsg = err.Error()
+				} else if !allowed {
+					log.Warnln("fetch '" + destUrl + "' denied by robots.txt.")
+					report.Done = types.FETCH_ROBOTS_DENIED
+					report.ErrorClass = types.ERR_CLASS_ROBOTS_DENIED
+				}
+				if err != nil || !allowed {
+					if this.report(report) {
+						this.taskFinished(taskPack.TaskId)
+					}
+					continue
+				}
+			}
 			log.Debugln("goto fetch ", destUrl)
-			done := 0
-			if err == nil {
+			//周期任务带上次的校验信息做条件请求，页面未变化时返回304
+			headers := map[string]string{}
+			if taskPack.Etag != "" {
+				headers["If-None-Match"] = taskPack.Etag
+			}
+			if taskPack.LastModified != "" {
+				headers["If-Modified-Since"] = taskPack.LastModified
+			}
+			resp, err := httpClient.Fetch(destUrl, headers)
+			report.StatusCode = resp.StatusCode
+			report.FinalUrl = resp.FinalUrl
+			report.ContentType = resp.ContentType
+			report.Bytes = int64(len(resp.Body))
+			report.Latency = int64(resp.Latency / time.Millisecond)
+			report.Etag = resp.Etag
+			report.LastModified = resp.LastModified
+			if err == nil && resp.StatusCode == http.StatusNotModified {
+				//页面未变化，不保存新版本
+				log.Infoln("fetch '" + destUrl + "' not modified.")
+				report.Done = types.FETCH_DONE
+				report.Unchanged = true
+				report.Etag = taskPack.Etag
+				report.LastModified = taskPack.LastModified
+				if resp.Etag != "" {
+					report.Etag = resp.Etag
+				}
+				if resp.LastModified != "" {
+					report.LastModified = resp.LastModified
+				}
+			} else if err == nil {
 				//report success to scheduler, make a log, save html
-				html, err = httpClient.IconvHtml(html, "utf-8")
-				done = 1
-				log.Infoln("fetch '" + destUrl + "' done.")
-				err = pageStore.Save(taskPack.Domain, taskPack.Urlpath, string(html))
+				html, pageCharset, err := httpClient.DecodeHtml(resp.Body, resp.ContentType)
 				if err != nil {
-					log.Errorln("fetcher save ", taskPack.Domain, taskPack.Urlpath, " error:", err)
+					log.Warnln("decode '"+destUrl+"' from ", pageCharset, " error: ", err)
+				}
+				report.Done = types.FETCH_DONE
+				report.ContentHash = lib.ContentHash(html)
+				report.Simhash = lib.SimHash(html)
+				if taskPack.ContentHash != "" && report.ContentHash == taskPack.ContentHash {
+					//内容与上一版本完全相同，不保存新版本
+					log.Infoln("fetch '" + destUrl + "' done, content unchanged.")
+					report.Unchanged = true
+				} else {
+					log.Infoln("fetch '" + destUrl + "' done.")
+					meta := types.PageMeta{
+						TaskId:      taskPack.TaskId,
+						Url:         resp.FinalUrl,
+						StatusCode:  resp.StatusCode,
+						Headers:     resp.Header,
+						ContentType: resp.ContentType,
+						Charset:     pageCharset,
+						FetchTime:   report.FetchTime}
+					report.PageKey, err = pageStore.Save(taskPack.Domain, taskPack.Urlpath, html, meta)
+					if err != nil {
+						//页面没有保存，按失败报告并清除指纹，否则scheduler记下指纹后以后的抓取都会认为内容未变
+						log.Errorln("fetcher save ", taskPack.Domain, taskPack.Urlpath, " error:", err)
+						report.Done = types.FETCH_FAILED
+						report.ErrorClass = types.ERR_CLASS_STORE
+						report.ErrorMsg = err.Error()
+						report.ContentHash = ""
+						report.Simhash = 0
+					} else {
+						var fields map[string][]string
+						if taskPack.Xpath != "" {
+							report.DataKey, fields = this.extractFields(pageStore, taskPack, html)
+						}
+						if taskPack.Watch != types.WATCH_NONE {
+							this.detectChange(pageStore, taskPack, html, fields, report)
+						}
+						if taskPack.FollowLinks {
+							links := ExtractLinks(html, resp.FinalUrl)
+							log.Debugln("extract ", len(links), " links from ", destUrl)
+							this.reportLinks(httpClient, taskPack, links)
+						}
+					}
 				}
 			} else {
 				//report fail to scheduler
 				log.Errorln("fetch '"+destUrl+"' failed!", err)
+				report.ErrorClass = lib.ClassifyError(err)
+				report.ErrorMsg = err.Error()
 			}
-			//向scheduler报告任务完成情况
-			reportUrl := fmt.Sprintf("http://%s%s?task_id=%d&done=%d", this.scheduler_addr, this.scheduler_api["report"], taskPack.TaskId, done)
-			res, err := httpClient.Get(reportUrl)
-			if err != nil {
-				log.Errorln("report ", reportUrl, " failed!")
-			} else {
-				result := types.JsonResult{}
-				err = json.Unmarshal(res, &result)
-				if err != nil || result.Err != 0 {
-					log.Errorln("report ", reportUrl, ", get error response: ", string(res))
-				}
+			if this.report(report) {
+				this.taskFinished(taskPack.TaskId)
 			}
 		case <-this.quitChan:
 			//this.quitChan should be closed somewhere
@@ -178,3 +650,112 @@ loop:
 		}
 	}
 }
+
+//把任务完成情况放入outbox，由后台发送给scheduler；
+//写入失败时返回false，任务不标记为完成，重启后重新抓取
+func (this *Fetcher) report(report types.FetchReport) bool {
+	err := this.outbox.Add(report)
+	if err != nil {
+		log.Errorln("write report of task ", report.TaskId, " to outbox error: ", err)
+		return false
+	}
+	return true
+}
+
+//按任务的xpath抽取字段，结果以json保存在页面旁边，返回保存的key和抽取的字段
+func (this *Fetcher) extractFields(pageStore PageStore, taskPack types.TaskPack, html []byte) (string, map[string][]string) {
+	destUrl := taskPack.Domain + taskPack.Urlpath
+	fields, err := ExtractFields(html, taskPack.Xpath)
+	if err != nil {
+		log.Errorln("extract fields from ", destUrl, " with xpath ", taskPack.Xpath, " error: ", err)
+		return "", nil
+	}
+	result := types.ExtractResult{TaskId: taskPack.TaskId, Url: destUrl, FetchTime: time.Now().Unix(), Fields: fields}
+	jsonBytes, err := json.Marshal(result)
+	if err != nil {
+		log.Errorln("make extract result json error: ", err)
+		return "", fields
+	}
+	dataKey, err := pageStore.SaveExtracted(taskPack.Domain, taskPack.Urlpath, jsonBytes)
+	if err != nil {
+		log.Errorln("fetcher save extracted data of ", destUrl, " error:", err)
+	}
+	return dataKey, fields
+}
+
+//与上一版本比较，有变化时通知webhook；没有上一版本（首次抓取）时不通知
+func (this *Fetcher) detectChange(pageStore PageStore, taskPack types.TaskPack, html []byte, fields map[string][]string, report types.FetchReport) {
+	destUrl := taskPack.Domain + taskPack.Urlpath
+	var summary types.ChangeSummary
+	var changed bool
+	switch taskPack.Watch {
+	case types.WATCH_PAGE:
+		if taskPack.PageKey == "" {
+			return
+		}
+		oldPage, err := pageStore.Load(taskPack.PageKey)
+		if err != nil {
+			log.Errorln("load previous page ", taskPack.PageKey, " of ", destUrl, " error: ", err)
+			return
+		}
+		summary, changed = DetectPageChange(oldPage, html)
+	case types.WATCH_XPATH:
+		if taskPack.DataKey == "" || fields == nil {
+			return
+		}
+		data, err := pageStore.Load(taskPack.DataKey)
+		if err != nil {
+			log.Errorln("load previous extracted data ", taskPack.DataKey, " of ", destUrl, " error: ", err)
+			return
+		}
+		oldResult := types.ExtractResult{}
+		err = json.Unmarshal(data, &oldResult)
+		if err != nil {
+			log.Errorln("unmarshal previous extracted data ", taskPack.DataKey, " error: ", err)
+			return
+		}
+		summary, changed = DetectFieldChange(oldResult.Fields, fields)
+	default:
+		return
+	}
+	if !changed {
+		log.Debugln("no watched change in ", destUrl)
+		return
+	}
+	log.Infoln("detect change in ", destUrl, ", added: ", summary.Added, ", removed: ", summary.Removed)
+	event := types.ChangeEvent{
+		TaskId:      taskPack.TaskId,
+		Url:         destUrl,
+		Watch:       taskPack.Watch,
+		DetectTime:  time.Now().Unix(),
+		PrevPageKey: taskPack.PageKey,
+		PageKey:     report.PageKey,
+		Summary:     summary}
+	this.notifier.Notify(taskPack.Webhook, event)
+}
+
+//把页面中发现的链接发给scheduler，由scheduler生成新任务
+func (this *Fetcher) reportLinks(httpClient *lib.HttpClient, taskPack types.TaskPack, links []string) {
+	if len(links) == 0 {
+		return
+	}
+	jsonBytes, err := json.Marshal(links)
+	if err != nil {
+		log.Errorln("make links json error: ", err)
+		return
+	}
+	reportUrl := fmt.Sprintf("http://%s%s", this.scheduler_addr, this.scheduler_api["links"])
+	param := url.Values{}
+	param.Add("task_id", strconv.Itoa(int(taskPack.TaskId)))
+	param.Add("links", string(jsonBytes))
+	res, err := httpClient.Post(reportUrl, param)
+	if err != nil {
+		log.Errorln("report links of task ", taskPack.TaskId, " failed!", err)
+	} else {
+		result := types.JsonResult{}
+		err = json.Unmarshal(res, &result)
+		if err != nil || result.Err != 0 {
+			log.Errorln("report links ", reportUrl, ", get error response: ", string(res))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/types"
+	"github.com/zhaozhi406/crawler/utils"
+)
+
+//启动时向scheduler注册，之后定期发送心跳，退出时注销；scheduler_api中没有register时不注册
+func (this *Fetcher) heartbeat() {
+	registerApi := this.scheduler_api["register"]
+	if registerApi == "" {
+		return
+	}
+	heartbeatApi := this.scheduler_api["heartbeat"]
+	if heartbeatApi == "" {
+		heartbeatApi = registerApi
+	}
+	if this.sendFetcherInfo(registerApi) {
+		log.Infoln("register to scheduler as ", this.advertiseAddr)
+	}
+	ticker := time.NewTicker(this.beatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.sendFetcherInfo(heartbeatApi)
+		case <-this.quitChan:
+			this.unregister()
+			return
+		}
+	}
+}
+
+func (this *Fetcher) fetcherInfo() types.FetcherInfo {
+	queueLen := len(this.taskQueue)
+	info := types.FetcherInfo{
+		Addr:      this.advertiseAddr,
+		Workers:   this.nWorkers,
+		QueueSize: cap(this.taskQueue),
+		TaskMode:  this.taskMode,
+		QueueLen:  queueLen,
+		FreeSlots: cap(this.taskQueue) - queueLen}
+	if this.quitting() {
+		info.FreeSlots = 0
+	}
+	if this.taskMode == TASK_MODE_REDIS {
+		info.TaskQueue = this.queueName
+	}
+	return info
+}
+
+func (this *Fetcher) sendFetcherInfo(api string) bool {
+	apiUrl := fmt.Sprintf("http://%s%s", this.scheduler_addr, api)
+	jsonBytes, err := json.Marshal(this.fetcherInfo())
+	if err != nil {
+		log.Errorln("make fetcher info json error: ", err)
+		return false
+	}
+	res, err := this.httpClient.PostJson(apiUrl, jsonBytes)
+	if err != nil {
+		log.Errorln("send fetcher info to ", apiUrl, " failed! error: ", err)
+		return false
+	}
+	result := types.JsonResult{}
+	err = json.Unmarshal(res, &result)
+	if err != nil || result.Err != ErrOk {
+		log.Errorln("send fetcher info to ", apiUrl, ", get error response: ", string(res))
+		return false
+	}
+	return true
+}
+
+//fetcher的当前状态，scheduler据此决定推送的任务数
+func (this *Fetcher) statusHandler(w http.ResponseWriter, req *http.Request) {
+	result := types.JsonResult{Err: ErrOk, Data: this.fetcherInfo()}
+	utils.OutputJsonResult(w, result)
+}
+
+//退出时注销，scheduler不再推送任务
+func (this *Fetcher) unregister() {
+	api := this.scheduler_api["unregister"]
+	if api == "" {
+		return
+	}
+	apiUrl := fmt.Sprintf("http://%s%s", this.scheduler_addr, api)
+	param := url.Values{}
+	param.Add("addr", this.advertiseAddr)
+	res, err := this.httpClient.Post(apiUrl, param)
+	if err != nil {
+		log.Errorln("unregister from scheduler failed! error: ", err)
+		return
+	}
+	log.Infoln("unregister from scheduler, response: ", string(res))
+}
@@ -0,0 +1,240 @@
+package fetcher
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/kdar/factorlog"
+)
+
+//记录数超过该值且大部分已完成时压缩
+const jsonLogCompactThreshold = 10000
+
+//jsonLog的一条记录，每行一个json
+type jsonLogEntry struct {
+	Op   string          `json:"op"` //add: 保存一项数据，done: 该项已完成
+	Id   string          `json:"id"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+//追加写的json-lines日志，保存未完成的数据：add记录写入时sync，done记录不sync（丢失只会导致重复处理）；
+//打开时重放得到未完成的数据（按首次写入的顺序），并压缩掉已完成的记录。path为空时只保存在内存中
+type jsonLog struct {
+	path    string
+	lock    sync.Mutex
+	file    *os.File
+	pending map[string]json.RawMessage
+	order   []string //pending数据的写入顺序，可能包含已完成或重复的id
+	entries int
+}
+
+func openJsonLog(path string) (*jsonLog, error) {
+	jl := &jsonLog{path: path, pending: map[string]json.RawMessage{}}
+	if path == "" {
+		return jl, nil
+	}
+	err := jl.replay()
+	if err == nil {
+		err = jl.compact()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jl, nil
+}
+
+func (this *jsonLog) replay() error {
+	file, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := jsonLogEntry{}
+		//最后一行可能因为崩溃只写了一半，跳过
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			log.Warnln("skip broken line in ", this.path, ": ", scanner.Text())
+			continue
+		}
+		this.apply(entry)
+	}
+	return scanner.Err()
+}
+
+func (this *jsonLog) apply(entry jsonLogEntry) {
+	switch entry.Op {
+	case "add":
+		if _, ok := this.pending[entry.Id]; !ok {
+			this.order = append(this.order, entry.Id)
+		}
+		this.pending[entry.Id] = entry.Data
+	case "done":
+		delete(this.pending, entry.Id)
+	}
+}
+
+//按写入顺序返回最多max项未完成的数据，max<=0时返回全部；同时清理order
+func (this *jsonLog) pendingItems(max int) []json.RawMessage {
+	items := []json.RawMessage{}
+	order := []string{}
+	//完成后再次写入的id在order中出现多次，只保留第一次
+	seen := map[string]bool{}
+	for _, id := range this.order {
+		if data, ok := this.pending[id]; ok && !seen[id] {
+			order = append(order, id)
+			seen[id] = true
+			if max <= 0 || len(items) < max {
+				items = append(items, data)
+			}
+		}
+	}
+	this.order = order
+	return items
+}
+
+//只保留未完成数据的add记录，写临时文件后替换
+func (this *jsonLog) compact() error {
+	tmpPath := this.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	this.pendingItems(0)
+	writer := bufio.NewWriter(tmpFile)
+	for _, id := range this.order {
+		line, _ := json.Marshal(jsonLogEntry{Op: "add", Id: id, Data: this.pending[id]})
+		writer.Write(append(line, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	if this.file != nil {
+		this.file.Close()
+		this.file = nil
+	}
+	err = os.Rename(tmpPath, this.path)
+	if err != nil {
+		return err
+	}
+	this.file, err = os.OpenFile(this.path, os.O_APPEND|os.O_WRONLY, 0666)
+	this.entries = len(this.order)
+	return err
+}
+
+func (this *jsonLog) write(entries []jsonLogEntry, sync bool) error {
+	if this.path != "" {
+		if this.file == nil {
+			return fmt.Errorf("%s is closed", this.path)
+		}
+		buf := []byte{}
+		for _, entry := range entries {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			buf = append(buf, line...)
+			buf = append(buf, '\n')
+		}
+		_, err := this.file.Write(buf)
+		if err == nil && sync {
+			err = this.file.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		this.apply(entry)
+	}
+	this.entries += len(entries)
+	return nil
+}
+
+//保存数据，ids[i]为values[i]的id，写入磁盘后才返回
+func (this *jsonLog) Add(ids []string, values []interface{}) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	entries := []jsonLogEntry{}
+	for i, id := range ids {
+		data, err := json.Marshal(values[i])
+		if err != nil {
+			return err
+		}
+		entries = append(entries, jsonLogEntry{Op: "add", Id: id, Data: data})
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.write(entries, true)
+}
+
+//标记数据已完成
+func (this *jsonLog) Done(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	entries := []jsonLogEntry{}
+	for _, id := range ids {
+		entries = append(entries, jsonLogEntry{Op: "done", Id: id})
+	}
+	err := this.write(entries, false)
+	if err == nil && this.path != "" && this.entries > jsonLogCompactThreshold && len(this.pending)*2 < this.entries {
+		err = this.compact()
+	}
+	return err
+}
+
+//按写入顺序返回最多max项未完成的数据，max<=0时返回全部
+func (this *jsonLog) Pending(max int) []json.RawMessage {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.pendingItems(max)
+}
+
+//按写入顺序返回所有未完成数据的id和数据
+func (this *jsonLog) Items() ([]string, []json.RawMessage) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	items := this.pendingItems(0)
+	return append([]string{}, this.order...), items
+}
+
+//未完成的数据项数
+func (this *jsonLog) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.pending)
+}
+
+//随机生成数据项的id
+func newLogId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func (this *jsonLog) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
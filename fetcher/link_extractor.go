@@ -0,0 +1,73 @@
+package fetcher
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+//从html中抽取<a href>链接，并以baseUrl为基准转为绝对地址；
+//只保留http(s)链接，去掉锚点，结果去重
+func ExtractLinks(page []byte, baseUrl string) []string {
+	base, err := url.Parse(baseUrl)
+	if err != nil {
+		return nil
+	}
+
+	links := []string{}
+	seen := map[string]bool{}
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	for {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data == "base" {
+			//页面中的<base href>会改变相对链接的基准
+			for _, attr := range token.Attr {
+				if attr.Key == "href" {
+					if u, err := base.Parse(strings.TrimSpace(attr.Val)); err == nil {
+						base = u
+					}
+				}
+			}
+			continue
+		}
+		if token.Data != "a" {
+			continue
+		}
+		for _, attr := range token.Attr {
+			if attr.Key != "href" {
+				continue
+			}
+			link := resolveLink(base, attr.Val)
+			if link != "" && !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+		}
+	}
+	return links
+}
+
+func resolveLink(base *url.URL, href string) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") {
+		return ""
+	}
+	u, err := base.Parse(href)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	u.Fragment = ""
+	return u.String()
+}
@@ -2,47 +2,254 @@ package fetcher
 
 import (
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
 )
 
+//元数据文件的后缀，保存为 <页面版本>.meta.json
+const metaSuffix = ".meta.json"
+
+//页面保存在 dir/domain/md5(urlpath)/<版本>，compression为gzip或zstd时文件名带.gz或.zst后缀
 type LocalPageStore struct {
-	dir string
+	dir         string
+	compression string
 }
 
-func InitLocalPageStore(dir string) *LocalPageStore {
+func InitLocalPageStore(dir string, compression string) *LocalPageStore {
 	err := os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
 		log.Errorln("LocalPageStore mkdir ", dir, " error: ", err)
 		return nil
 	}
-	return &LocalPageStore{dir: dir}
+	if lib.CompressionExt(compression) == "" && compression != lib.COMPRESSION_NONE {
+		log.Errorln("LocalPageStore unknown compression ", compression, ", save pages uncompressed.")
+		compression = lib.COMPRESSION_NONE
+	}
+	return &LocalPageStore{dir: dir, compression: compression}
 }
 
-func (this *LocalPageStore) Save(domain string, urlpath string, page string) error {
-	md5Bytes := md5.Sum([]byte(urlpath))
+func (this *LocalPageStore) Save(domain string, urlpath string, page []byte, meta types.PageMeta) (string, error) {
+	destDir := this.pageDir(domain, urlpath)
 	domain = this.canonicalDomain(domain)
-	destDir := filepath.Join(this.dir, domain, fmt.Sprintf("%x", md5Bytes))
 	log.Debugln("destDir: ", destDir)
+	fname := ""
 	err := os.MkdirAll(destDir, os.ModePerm)
 	if err != nil {
 		log.Errorln("mkdir for '"+domain+"/"+urlpath+"' error: ", err)
 	} else {
 		now := time.Now().Unix()
-		fname := fmt.Sprintf("%s/%d", destDir, now)
-		err = ioutil.WriteFile(fname, []byte(page), 0666)
+		versionPath := fmt.Sprintf("%s/%d", destDir, now)
+		fname = versionPath + lib.CompressionExt(this.compression)
+		//先压缩，压缩失败时不留下没有页面的元数据
+		page, err = lib.Compress(page, this.compression)
+		if err == nil {
+			err = this.saveMeta(versionPath, meta)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(fname, page, 0666)
+		}
 		if err != nil {
 			log.Errorln("save page: "+domain+"/"+urlpath+" error:", err)
 		}
 	}
 
-	return err
+	return fname, err
+}
+
+//抽取结果保存为 <页面版本>.json，和对应的页面文件放在同一目录
+func (this *LocalPageStore) SaveExtracted(domain string, urlpath string, data []byte) (string, error) {
+	destDir := this.pageDir(domain, urlpath)
+	version := this.latestVersion(destDir)
+	if version == 0 {
+		version = time.Now().Unix()
+	}
+	err := os.MkdirAll(destDir, os.ModePerm)
+	if err != nil {
+		log.Errorln("mkdir for '"+domain+"/"+urlpath+"' error: ", err)
+		return "", err
+	}
+	fname := fmt.Sprintf("%s/%d.json", destDir, version)
+	err = ioutil.WriteFile(fname, data, 0666)
+	if err != nil {
+		log.Errorln("save extracted data: "+domain+"/"+urlpath+" error:", err)
+	}
+	return fname, err
+}
+
+//key为保存时返回的文件路径，只允许读取dir下的文件；压缩的页面按后缀解压
+func (this *LocalPageStore) Load(key string) ([]byte, error) {
+	dir, err := filepath.Abs(this.dir)
+	if err != nil {
+		return nil, err
+	}
+	fname, err := filepath.Abs(key)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(fname, dir+string(filepath.Separator)) {
+		return nil, errors.New("page key out of store dir: " + key)
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return lib.Decompress(data, lib.CompressionOfFile(fname))
+}
+
+func (this *LocalPageStore) LoadMeta(key string) (types.PageMeta, error) {
+	versionPath := strings.TrimSuffix(key, lib.CompressionExt(lib.CompressionOfFile(key)))
+	data, err := this.Load(versionPath + metaSuffix)
+	if err != nil {
+		return types.PageMeta{}, err
+	}
+	return unmarshalMeta(data)
+}
+
+//先写元数据再写页面，保证列出的版本都有元数据
+func (this *LocalPageStore) saveMeta(versionPath string, meta types.PageMeta) error {
+	data, err := marshalMeta(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(versionPath+metaSuffix, data, 0666)
+}
+
+//修改过压缩方式后，旧版本可能以其他方式压缩，依次尝试
+func (this *LocalPageStore) Get(domain string, urlpath string, version int64) ([]byte, error) {
+	versionPath := filepath.Join(this.pageDir(domain, urlpath), strconv.FormatInt(version, 10))
+	for _, compression := range []string{this.compression, lib.COMPRESSION_NONE, lib.COMPRESSION_GZIP, lib.COMPRESSION_ZSTD} {
+		page, err := this.Load(versionPath + lib.CompressionExt(compression))
+		if !os.IsNotExist(err) {
+			return page, err
+		}
+	}
+	return nil, ErrPageNotFound
+}
+
+func (this *LocalPageStore) ListVersions(domain string, urlpath string) ([]int64, error) {
+	files, err := ioutil.ReadDir(this.pageDir(domain, urlpath))
+	if os.IsNotExist(err) {
+		return []int64{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	versions := []int64{}
+	for _, f := range files {
+		version, ok := pageVersion(f.Name())
+		if ok && (len(versions) == 0 || versions[len(versions)-1] != version) {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+func (this *LocalPageStore) Latest(domain string, urlpath string) (int64, []byte, error) {
+	version := this.latestVersion(this.pageDir(domain, urlpath))
+	if version == 0 {
+		return 0, nil, ErrPageNotFound
+	}
+	page, err := this.Get(domain, urlpath, version)
+	return version, page, err
+}
+
+func (this *LocalPageStore) pageDir(domain string, urlpath string) string {
+	md5Bytes := md5.Sum([]byte(urlpath))
+	return filepath.Join(this.dir, this.canonicalDomain(domain), fmt.Sprintf("%x", md5Bytes))
+}
+
+//目录下最新的页面版本（文件名即保存时间戳），没有则返回0
+func (this *LocalPageStore) latestVersion(destDir string) int64 {
+	files, err := ioutil.ReadDir(destDir)
+	if err != nil {
+		return 0
+	}
+	var latest int64 = 0
+	for _, f := range files {
+		version, ok := pageVersion(f.Name())
+		if ok && version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
+
+//页面文件名为 <版本> 或带压缩后缀，元数据和抽取结果的文件不算
+func pageVersion(fname string) (int64, bool) {
+	fname = strings.TrimSuffix(fname, lib.CompressionExt(lib.CompressionOfFile(fname)))
+	version, err := strconv.ParseInt(fname, 10, 64)
+	return version, err == nil
+}
+
+//文件名开头的版本号，同一版本的页面、元数据和抽取结果都以它开头
+func fileVersion(fname string) (int64, bool) {
+	if pos := strings.Index(fname, "."); pos >= 0 {
+		fname = fname[:pos]
+	}
+	version, err := strconv.ParseInt(fname, 10, 64)
+	return version, err == nil
+}
+
+//按保留策略删除旧版本：保留最近keepVersions个版本，以及maxAge之内的版本；
+//两者都为0时不删除，最新的版本总是保留
+func (this *LocalPageStore) Sweep(keepVersions int, maxAge time.Duration) (SweepStats, error) {
+	stats := SweepStats{}
+	if keepVersions <= 0 && maxAge <= 0 {
+		return stats, nil
+	}
+	cutoff := time.Now().Add(-maxAge).Unix()
+	pageDirs, err := filepath.Glob(filepath.Join(this.dir, "*", "*"))
+	if err != nil {
+		return stats, err
+	}
+	for _, pageDir := range pageDirs {
+		files, err := ioutil.ReadDir(pageDir)
+		if err != nil {
+			continue
+		}
+		stats.PageDirs++
+		versionFiles := map[int64][]os.FileInfo{}
+		versions := []int64{}
+		for _, f := range files {
+			version, ok := fileVersion(f.Name())
+			if !ok || f.IsDir() {
+				continue
+			}
+			if _, exists := versionFiles[version]; !exists {
+				versions = append(versions, version)
+			}
+			versionFiles[version] = append(versionFiles[version], f)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+		for i, version := range versions {
+			if i == 0 || (keepVersions > 0 && i < keepVersions) || (maxAge > 0 && version >= cutoff) {
+				continue
+			}
+			for _, f := range versionFiles[version] {
+				err = os.Remove(filepath.Join(pageDir, f.Name()))
+				if err != nil {
+					log.Errorln("sweeper remove ", filepath.Join(pageDir, f.Name()), " error: ", err)
+					stats.Errors++
+					continue
+				}
+				stats.FilesRemoved++
+				stats.BytesFreed += f.Size()
+			}
+			stats.VersionsRemoved++
+		}
+	}
+	return stats, nil
 }
 
 //only save real domain, remove protocol part
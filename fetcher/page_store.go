@@ -1,5 +1,42 @@
 package fetcher
 
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/zhaozhi406/crawler/types"
+)
+
+var (
+	//没有找到指定的页面或版本
+	ErrPageNotFound = errors.New("page not found")
+	//存储不支持按domain, urlpath查找版本
+	ErrVersionsNotSupported = errors.New("page store does not support versions")
+)
+
 type PageStore interface {
-	Save(domain string, urlpath string, page string) error
+	//保存页面及其抓取元数据，元数据和页面放在一起；返回可用于查找该页面的key
+	Save(domain string, urlpath string, page []byte, meta types.PageMeta) (string, error)
+	//保存从页面抽取出的结构化数据，与最近一次保存的页面放在一起
+	SaveExtracted(domain string, urlpath string, data []byte) (string, error)
+	//根据Save或SaveExtracted返回的key读取内容
+	Load(key string) ([]byte, error)
+	//根据Save返回的key读取页面的元数据
+	LoadMeta(key string) (types.PageMeta, error)
+	//读取页面的指定版本，版本号为保存时的时间戳
+	Get(domain string, urlpath string, version int64) ([]byte, error)
+	//列出页面的所有版本，按从旧到新排序
+	ListVersions(domain string, urlpath string) ([]int64, error)
+	//读取页面的最新版本，返回版本号和内容
+	Latest(domain string, urlpath string) (int64, []byte, error)
+}
+
+func marshalMeta(meta types.PageMeta) ([]byte, error) {
+	return json.Marshal(meta)
+}
+
+func unmarshalMeta(data []byte) (types.PageMeta, error) {
+	meta := types.PageMeta{}
+	err := json.Unmarshal(data, &meta)
+	return meta, err
 }
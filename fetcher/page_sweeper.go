@@ -0,0 +1,88 @@
+package fetcher
+
+import (
+	"expvar"
+	"time"
+
+	log "github.com/kdar/factorlog"
+)
+
+//一次清理的统计
+type SweepStats struct {
+	PageDirs        int64
+	VersionsRemoved int64
+	FilesRemoved    int64
+	BytesFreed      int64
+	Errors          int64
+}
+
+//支持按保留策略清理旧版本的PageStore
+type sweepablePageStore interface {
+	Sweep(keepVersions int, maxAge time.Duration) (SweepStats, error)
+}
+
+//清理的累计指标，通过fetcher的/debug/vars输出
+var sweeperMetrics = expvar.NewMap("page_sweeper")
+
+//后台定期按保留策略清理PageStore中的旧版本
+type PageSweeper struct {
+	store        sweepablePageStore
+	keepVersions int
+	maxAge       time.Duration
+	period       time.Duration
+	quitChan     chan bool
+}
+
+func InitPageSweeper(store sweepablePageStore, keepVersions int, maxAge time.Duration, period time.Duration) *PageSweeper {
+	return &PageSweeper{
+		store:        store,
+		keepVersions: keepVersions,
+		maxAge:       maxAge,
+		period:       period,
+		quitChan:     make(chan bool)}
+}
+
+func (this *PageSweeper) Run() {
+	ticker := time.NewTicker(this.period)
+	defer ticker.Stop()
+	log.Infoln("start page sweeper, keep versions: ", this.keepVersions, ", max age: ", this.maxAge, ", period: ", this.period)
+	for {
+		select {
+		case <-ticker.C:
+			this.SweepOnce()
+		case <-this.quitChan:
+			log.Infoln("quit page sweeper...")
+			return
+		}
+	}
+}
+
+func (this *PageSweeper) Stop() {
+	close(this.quitChan)
+}
+
+//执行一次清理，记录日志和指标
+func (this *PageSweeper) SweepOnce() SweepStats {
+	start := time.Now()
+	stats, err := this.store.Sweep(this.keepVersions, this.maxAge)
+	duration := time.Since(start)
+	if err != nil {
+		log.Errorln("page sweeper error: ", err)
+		stats.Errors++
+	}
+	log.Infoln("page sweeper scanned ", stats.PageDirs, " pages, removed ", stats.VersionsRemoved, " versions, ",
+		stats.FilesRemoved, " files, freed ", stats.BytesFreed, " bytes, errors: ", stats.Errors, ", cost ", duration)
+
+	sweeperMetrics.Add("runs", 1)
+	sweeperMetrics.Add("versions_removed", stats.VersionsRemoved)
+	sweeperMetrics.Add("files_removed", stats.FilesRemoved)
+	sweeperMetrics.Add("bytes_freed", stats.BytesFreed)
+	sweeperMetrics.Add("errors", stats.Errors)
+	lastRun := new(expvar.Int)
+	lastRun.Set(start.Unix())
+	sweeperMetrics.Set("last_run", lastRun)
+	lastDuration := new(expvar.Int)
+	lastDuration.Set(int64(duration / time.Millisecond))
+	sweeperMetrics.Set("last_duration_ms", lastDuration)
+	return stats
+}
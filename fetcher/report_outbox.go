@@ -0,0 +1,177 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//任务报告的发件箱：报告先写入本地文件并sync，由后台goroutine批量发给scheduler，
+//失败后按指数退避重试，scheduler确认后追加done记录；启动时重放未确认的报告。
+//path为空时只保存在内存中，fetcher重启后丢失
+type ReportOutbox struct {
+	path       string
+	log        *jsonLog
+	httpClient *lib.HttpClient
+	reportUrl  string
+	batchSize  int
+	retryBase  time.Duration
+	retryMax   time.Duration
+	notify     chan bool
+	quitChan   chan bool
+	doneChan   chan bool
+}
+
+func InitReportOutbox(path string, httpClient *lib.HttpClient, reportUrl string, batchSize int, retryBase time.Duration, retryMax time.Duration) (*ReportOutbox, error) {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if retryBase <= 0 {
+		retryBase = time.Second
+	}
+	if retryMax < retryBase {
+		retryMax = retryBase
+	}
+	jl, err := openJsonLog(path)
+	if err != nil {
+		return nil, err
+	}
+	if n := jl.Len(); n > 0 {
+		log.Warnln("replay ", n, " unsent reports from outbox ", path)
+	}
+	return &ReportOutbox{
+		path:       path,
+		log:        jl,
+		httpClient: httpClient,
+		reportUrl:  reportUrl,
+		batchSize:  batchSize,
+		retryBase:  retryBase,
+		retryMax:   retryMax,
+		notify:     make(chan bool, 1),
+		quitChan:   make(chan bool),
+		doneChan:   make(chan bool)}, nil
+}
+
+//保存报告，写入磁盘后才返回；没有report id时生成一个
+func (this *ReportOutbox) Add(report types.FetchReport) error {
+	if report.ReportId == "" {
+		report.ReportId = newLogId()
+	}
+	err := this.log.Add([]string{report.ReportId}, []interface{}{report})
+	if err != nil {
+		return err
+	}
+	select {
+	case this.notify <- true:
+	default:
+	}
+	return nil
+}
+
+func (this *ReportOutbox) nextBatch() []types.FetchReport {
+	reports := []types.FetchReport{}
+	for _, data := range this.log.Pending(this.batchSize) {
+		report := types.FetchReport{}
+		if err := json.Unmarshal(data, &report); err != nil {
+			log.Errorln("drop broken report in outbox: ", string(data))
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+//未确认的报告数
+func (this *ReportOutbox) Pending() int {
+	return this.log.Len()
+}
+
+//后台发送报告，直到Stop
+func (this *ReportOutbox) Run() {
+	defer close(this.doneChan)
+	failures := 0
+	for {
+		batch := this.nextBatch()
+		if len(batch) == 0 {
+			select {
+			case <-this.notify:
+				continue
+			case <-this.quitChan:
+				return
+			}
+		}
+		if this.deliver(batch) {
+			failures = 0
+			continue
+		}
+		failures++
+		delay := this.retryBase
+		for i := 1; i < failures && delay < this.retryMax; i++ {
+			delay *= 2
+		}
+		if delay > this.retryMax {
+			delay = this.retryMax
+		}
+		log.Warnln(this.Pending(), " reports wait for delivery, retry after ", delay)
+		select {
+		case <-time.After(delay):
+		case <-this.quitChan:
+			this.flush()
+			return
+		}
+	}
+}
+
+//退出前尽量发送剩余的报告，发送失败的留在outbox中，下次启动时重新发送
+func (this *ReportOutbox) flush() {
+	for {
+		batch := this.nextBatch()
+		if len(batch) == 0 || !this.deliver(batch) {
+			return
+		}
+	}
+}
+
+//停止后台发送并关闭文件，会等待正在进行的发送完成
+func (this *ReportOutbox) Stop() {
+	close(this.quitChan)
+	<-this.doneChan
+	if n := this.log.Len(); n > 0 {
+		log.Warnln(n, " reports are not delivered, keep them in outbox ", this.path)
+	}
+	this.log.Close()
+}
+
+//把一批报告post给scheduler，scheduler返回已处理（包括重复）的report id；全部确认时返回true
+func (this *ReportOutbox) deliver(batch []types.FetchReport) bool {
+	jsonBytes, err := json.Marshal(batch)
+	if err != nil {
+		log.Errorln("make report json error: ", err)
+		return false
+	}
+	res, err := this.httpClient.PostJson(this.reportUrl, jsonBytes)
+	if err != nil {
+		log.Errorln("report ", len(batch), " tasks to ", this.reportUrl, " failed! error: ", err)
+		return false
+	}
+	accepted := []string{}
+	result := types.JsonResult{Data: &accepted}
+	err = json.Unmarshal(res, &result)
+	if err != nil || result.Err != ErrOk {
+		log.Errorln("report ", this.reportUrl, ", get error response: ", string(res))
+		return false
+	}
+	//丢失done记录只会导致重复投递，由scheduler去重
+	err = this.log.Done(accepted...)
+	if err != nil {
+		log.Errorln("write report outbox error: ", err)
+	}
+	if len(accepted) < len(batch) {
+		log.Warnln("scheduler accepts ", len(accepted), " of ", len(batch), " reports, response: ", string(res))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,341 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//默认的对象key模板
+const defaultS3KeyTemplate = "pages/{domain}/{md5}/{version}"
+
+//S3的配置
+type S3Config struct {
+	Endpoint           string //例如 http://minio:9000
+	Bucket             string
+	Region             string
+	AccessKey          string
+	SecretKey          string
+	KeyTemplate        string //支持{domain}, {md5}, {version}，{version}必须在最后
+	PathStyle          bool   //true: endpoint/bucket/key，false: bucket.endpoint/key
+	MultipartThreshold int64  //超过该大小的页面分片上传
+	PartSize           int64
+}
+
+//保存页面到S3兼容的对象存储（如MinIO），请求使用SigV4签名；
+//页面保存为按模板生成的key，元数据为 <key>.meta.json，抽取结果为 <key>.json
+type S3PageStore struct {
+	config     S3Config
+	endpoint   *url.URL
+	credential lib.AwsCredential
+	httpClient *lib.HttpClient
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3InitiateResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+func InitS3PageStore(config S3Config, httpClient *lib.HttpClient) (*S3PageStore, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.New("bad s3 endpoint: " + config.Endpoint)
+	}
+	if config.KeyTemplate == "" {
+		config.KeyTemplate = defaultS3KeyTemplate
+	}
+	if !strings.HasSuffix(config.KeyTemplate, "{version}") {
+		return nil, errors.New("s3 key template must end with {version}: " + config.KeyTemplate)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = 8 << 20
+	}
+	if config.MultipartThreshold <= 0 {
+		config.MultipartThreshold = 16 << 20
+	}
+	if httpClient == nil {
+		httpClient = lib.InitHttpClient(map[string]string{})
+	}
+	credential := lib.AwsCredential{AccessKey: config.AccessKey, SecretKey: config.SecretKey, Region: config.Region, Service: "s3"}
+	return &S3PageStore{config: config, endpoint: endpoint, credential: credential, httpClient: httpClient}, nil
+}
+
+func (this *S3PageStore) Save(domain string, urlpath string, page []byte, meta types.PageMeta) (string, error) {
+	key := this.objectKey(domain, urlpath, strconv.FormatInt(time.Now().Unix(), 10))
+	metaData, err := marshalMeta(meta)
+	if err == nil {
+		err = this.putObject(key+metaSuffix, metaData, "application/json")
+	}
+	if err == nil {
+		if int64(len(page)) > this.config.MultipartThreshold {
+			err = this.multipartUpload(key, page, "text/html; charset=utf-8")
+		} else {
+			err = this.putObject(key, page, "text/html; charset=utf-8")
+		}
+	}
+	if err != nil {
+		log.Errorln("save page: "+domain+urlpath+" to s3 error:", err)
+		return "", err
+	}
+	return key, nil
+}
+
+//抽取结果和最近一次保存的页面放在一起
+func (this *S3PageStore) SaveExtracted(domain string, urlpath string, data []byte) (string, error) {
+	versions, err := this.ListVersions(domain, urlpath)
+	if err != nil {
+		log.Errorln("list versions of ", domain+urlpath, " error: ", err)
+		return "", err
+	}
+	version := time.Now().Unix()
+	if len(versions) > 0 {
+		version = versions[len(versions)-1]
+	}
+	key := this.objectKey(domain, urlpath, strconv.FormatInt(version, 10)) + ".json"
+	err = this.putObject(key, data, "application/json")
+	if err != nil {
+		log.Errorln("save extracted data: "+domain+urlpath+" to s3 error:", err)
+		return "", err
+	}
+	return key, nil
+}
+
+func (this *S3PageStore) Load(key string) ([]byte, error) {
+	status, _, body, err := this.request("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, ErrPageNotFound
+	}
+	if status != http.StatusOK {
+		return nil, s3ResponseError("get "+key, status, body)
+	}
+	return body, nil
+}
+
+func (this *S3PageStore) LoadMeta(key string) (types.PageMeta, error) {
+	data, err := this.Load(key + metaSuffix)
+	if err != nil {
+		return types.PageMeta{}, err
+	}
+	return unmarshalMeta(data)
+}
+
+func (this *S3PageStore) Get(domain string, urlpath string, version int64) ([]byte, error) {
+	return this.Load(this.objectKey(domain, urlpath, strconv.FormatInt(version, 10)))
+}
+
+//用ListObjectsV2列出key模板{version}之前的前缀
+func (this *S3PageStore) ListVersions(domain string, urlpath string) ([]int64, error) {
+	prefix := this.objectKey(domain, urlpath, "")
+	versions := []int64{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		status, _, body, err := this.request("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			return nil, s3ResponseError("list "+prefix, status, body)
+		}
+		result := s3ListResult{}
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			version, err := strconv.ParseInt(strings.TrimPrefix(content.Key, prefix), 10, 64)
+			if err == nil {
+				versions = append(versions, version)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+func (this *S3PageStore) Latest(domain string, urlpath string) (int64, []byte, error) {
+	versions, err := this.ListVersions(domain, urlpath)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(versions) == 0 {
+		return 0, nil, ErrPageNotFound
+	}
+	version := versions[len(versions)-1]
+	page, err := this.Get(domain, urlpath, version)
+	return version, page, err
+}
+
+//按模板生成对象key，domain去掉协议部分，urlpath取md5
+func (this *S3PageStore) objectKey(domain string, urlpath string, version string) string {
+	if parts := strings.SplitN(domain, "//", 2); len(parts) > 1 {
+		domain = parts[1]
+	}
+	md5Bytes := md5.Sum([]byte(urlpath))
+	replacer := strings.NewReplacer("{domain}", domain, "{md5}", fmt.Sprintf("%x", md5Bytes), "{version}", version)
+	return replacer.Replace(this.config.KeyTemplate)
+}
+
+func (this *S3PageStore) putObject(key string, data []byte, contentType string) error {
+	headers := map[string]string{"Content-Type": contentType}
+	status, _, body, err := this.request("PUT", key, nil, headers, data)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return s3ResponseError("put "+key, status, body)
+	}
+	return nil
+}
+
+//分片上传：初始化，逐片上传，最后合并；失败时取消上传
+func (this *S3PageStore) multipartUpload(key string, data []byte, contentType string) error {
+	query := url.Values{}
+	query.Set("uploads", "")
+	status, _, body, err := this.request("POST", key, query, map[string]string{"Content-Type": contentType}, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return s3ResponseError("initiate multipart upload "+key, status, body)
+	}
+	initiate := s3InitiateResult{}
+	err = xml.Unmarshal(body, &initiate)
+	if err != nil || initiate.UploadId == "" {
+		return fmt.Errorf("initiate multipart upload %s returns no upload id: %s", key, string(body))
+	}
+
+	err = this.uploadParts(key, initiate.UploadId, data)
+	if err != nil {
+		abort := url.Values{}
+		abort.Set("uploadId", initiate.UploadId)
+		if _, _, _, abortErr := this.request("DELETE", key, abort, nil, nil); abortErr != nil {
+			log.Errorln("abort multipart upload ", key, " error: ", abortErr)
+		}
+	}
+	return err
+}
+
+func (this *S3PageStore) uploadParts(key string, uploadId string, data []byte) error {
+	complete := s3CompleteUpload{}
+	for offset, partNumber := int64(0), 1; offset < int64(len(data)); offset, partNumber = offset+this.config.PartSize, partNumber+1 {
+		end := offset + this.config.PartSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		query := url.Values{}
+		query.Set("partNumber", strconv.Itoa(partNumber))
+		query.Set("uploadId", uploadId)
+		status, header, body, err := this.request("PUT", key, query, nil, data[offset:end])
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return s3ResponseError(fmt.Sprintf("upload part %d of %s", partNumber, key), status, body)
+		}
+		complete.Parts = append(complete.Parts, s3CompletePart{PartNumber: partNumber, ETag: header.Get("ETag")})
+	}
+
+	completeXml, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("uploadId", uploadId)
+	status, _, body, err := this.request("POST", key, query, map[string]string{"Content-Type": "application/xml"}, completeXml)
+	if err != nil {
+		return err
+	}
+	//合并失败时也可能返回200，错误在body里
+	if status != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		return s3ResponseError("complete multipart upload "+key, status, body)
+	}
+	return nil
+}
+
+//构造并签名请求，key为空时请求bucket本身
+func (this *S3PageStore) request(method string, key string, query url.Values, headers map[string]string, data []byte) (int, http.Header, []byte, error) {
+	u := *this.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if this.config.PathStyle {
+		path += "/" + this.config.Bucket
+	} else {
+		u.Host = this.config.Bucket + "." + u.Host
+	}
+	path += "/" + key
+	u.Path = path
+	u.RawPath = lib.AwsEscapePath(path)
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for name, val := range headers {
+		req.Header.Set(name, val)
+	}
+	lib.SignV4(req, lib.PayloadHash(data), this.credential, time.Now())
+	return this.httpClient.DoRequest(req)
+}
+
+func s3ResponseError(action string, status int, body []byte) error {
+	s3Err := s3Error{}
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("s3 %s failed, status: %d, code: %s, message: %s", action, status, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("s3 %s failed, status: %d", action, status)
+}
@@ -0,0 +1,62 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"strconv"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//已接收任务的预写日志：任务放入队列前写入并sync，完成后追加done记录；
+//启动时重放，得到上次退出时未完成的任务
+type TaskJournal struct {
+	log *jsonLog
+}
+
+//打开journal，返回未完成的任务（按接收顺序），并压缩掉已完成的记录
+func InitTaskJournal(path string) (*TaskJournal, []types.TaskPack, error) {
+	jl, err := openJsonLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	tasks := []types.TaskPack{}
+	for _, data := range jl.Pending(0) {
+		pack := types.TaskPack{}
+		if err := json.Unmarshal(data, &pack); err != nil {
+			log.Warnln("skip broken task in journal ", path, ": ", string(data))
+			continue
+		}
+		tasks = append(tasks, pack)
+	}
+	return &TaskJournal{log: jl}, tasks, nil
+}
+
+//记录接收的任务，写入磁盘后才返回
+func (this *TaskJournal) Add(taskPacks []types.TaskPack) error {
+	ids := []string{}
+	values := []interface{}{}
+	for _, pack := range taskPacks {
+		ids = append(ids, strconv.Itoa(int(pack.TaskId)))
+		values = append(values, pack)
+	}
+	return this.log.Add(ids, values)
+}
+
+//记录任务已完成或已交还；丢失done记录只会导致重复抓取，不需要sync
+func (this *TaskJournal) Done(taskIds ...int32) error {
+	ids := []string{}
+	for _, taskId := range taskIds {
+		ids = append(ids, strconv.Itoa(int(taskId)))
+	}
+	return this.log.Done(ids...)
+}
+
+//未完成的任务数
+func (this *TaskJournal) Pending() int {
+	return this.log.Len()
+}
+
+func (this *TaskJournal) Close() error {
+	return this.log.Close()
+}
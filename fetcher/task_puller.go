@@ -0,0 +1,160 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//任务获取方式，push: 由scheduler推送到/push/tasks，pull: 有空闲时向scheduler拉取，redis: 从redis任务队列获取
+const (
+	TASK_MODE_PUSH  = "push"
+	TASK_MODE_PULL  = "pull"
+	TASK_MODE_REDIS = "redis"
+)
+
+//fetcher对外的地址，用于scheduler的礼貌访问控制；listen_addr没有host时使用主机名
+func advertiseAddr(config map[string]string) string {
+	if addr := config["advertise_addr"]; addr != "" {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(config["listen_addr"])
+	if err != nil || host != "" {
+		return config["listen_addr"]
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+//pull模式下按任务队列的空闲容量向scheduler拉取任务，没有任务时等待pullInterval
+func (this *Fetcher) pullTasks() {
+	for {
+		n := 0
+		free := cap(this.taskQueue) - len(this.taskQueue)
+		if free > this.pullBatch {
+			free = this.pullBatch
+		}
+		if free > 0 {
+			n = this.pullOnce(free)
+		}
+		if n > 0 {
+			continue
+		}
+		select {
+		case <-time.After(this.pullInterval):
+		case <-this.quitChan:
+			log.Infoln("quit pull tasks...")
+			return
+		}
+	}
+}
+
+//拉取最多max个任务放入队列，返回拉取到的任务数
+func (this *Fetcher) pullOnce(max int) int {
+	params := url.Values{}
+	params.Set("max", strconv.Itoa(max))
+	params.Set("fetcher", this.advertiseAddr)
+	pullUrl := fmt.Sprintf("http://%s%s?%s", this.scheduler_addr, this.scheduler_api["pull"], params.Encode())
+	res, err := this.httpClient.Get(pullUrl)
+	if err != nil {
+		log.Errorln("pull tasks from ", pullUrl, " error: ", err)
+		return 0
+	}
+	result := struct {
+		types.JsonResult
+		Data []types.TaskPack `json:"data,omitempty"`
+	}{}
+	err = json.Unmarshal(res, &result)
+	if err != nil || result.Err != ErrOk {
+		log.Errorln("pull tasks from ", pullUrl, ", get error response: ", string(res))
+		return 0
+	}
+	//只有本goroutine按空闲容量拉取，通常不会超时；未入队的任务等租约到期后重新调度
+	if n := this.enqueueTasks(result.Data, time.After(time.Second)); n < len(result.Data) {
+		log.Errorln("task queue full, drop ", len(result.Data)-n, " pulled tasks.")
+		return n
+	}
+	if len(result.Data) > 0 {
+		log.Infoln("pull ", len(result.Data), " tasks from scheduler.")
+	}
+	return len(result.Data)
+}
+
+//redis模式下从任务队列取任务，先把上次未完成的任务放回队列；
+//队列满时阻塞，最多只多取一个任务
+func (this *Fetcher) consumeQueue() {
+	queueKey := this.redisQueue.QueueKey(this.queueName)
+	processingKey := this.redisQueue.ProcessingKey(this.advertiseAddr)
+	n, err := this.redisQueue.Recover(processingKey, queueKey)
+	if err != nil {
+		log.Errorln("recover unfinished tasks from ", processingKey, " error: ", err)
+	} else if n > 0 {
+		log.Warnln("recover ", n, " unfinished tasks to ", queueKey)
+	}
+	for {
+		select {
+		case <-this.quitChan:
+			log.Infoln("quit consume task queue...")
+			return
+		default:
+		}
+		pack, raw, err := this.redisQueue.Pop(queueKey, processingKey, 1)
+		if err != nil {
+			log.Errorln("pop task from ", queueKey, " error: ", err, ", data: ", string(raw))
+			select {
+			case <-time.After(this.pullInterval):
+			case <-this.quitChan:
+			}
+			continue
+		}
+		if pack == nil {
+			continue
+		}
+		this.inflightLock.Lock()
+		this.inflight[pack.TaskId] = raw
+		this.inflightLock.Unlock()
+		select {
+		case this.taskQueue <- *pack:
+		case <-this.quitChan:
+			//任务留在processing list中，重启后放回队列
+			log.Infoln("quit consume task queue...")
+			return
+		}
+	}
+}
+
+//任务已报告结果，从redis的processing list删除
+func (this *Fetcher) ackTask(taskId int32) {
+	if this.redisQueue == nil {
+		return
+	}
+	this.inflightLock.Lock()
+	raw, ok := this.inflight[taskId]
+	delete(this.inflight, taskId)
+	this.inflightLock.Unlock()
+	if !ok {
+		return
+	}
+	err := this.redisQueue.Ack(this.redisQueue.ProcessingKey(this.advertiseAddr), raw)
+	if err != nil {
+		log.Errorln("ack task ", taskId, " error: ", err)
+	}
+}
+
+func configDuration(config map[string]string, key string, def time.Duration) time.Duration {
+	seconds, err := strconv.ParseFloat(config[key], 64)
+	if err != nil || seconds <= 0 {
+		return def
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,99 @@
+package fetcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+	"github.com/zhaozhi406/crawler/utils"
+)
+
+//模拟scheduler的/pull/tasks，每次返回max个任务，记录每次请求的max
+type pullStub struct {
+	lock   sync.Mutex
+	maxes  []int
+	nextId int32
+}
+
+func (this *pullStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	max, _ := strconv.Atoi(req.FormValue("max"))
+	this.lock.Lock()
+	this.maxes = append(this.maxes, max)
+	packs := []types.TaskPack{}
+	for i := 0; i < max; i++ {
+		this.nextId++
+		packs = append(packs, types.TaskPack{TaskId: this.nextId, Domain: req.FormValue("fetcher")})
+	}
+	this.lock.Unlock()
+	utils.OutputJsonResult(w, types.JsonResult{Err: ErrOk, Data: packs})
+}
+
+func (this *pullStub) requests() []int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]int{}, this.maxes...)
+}
+
+func newPullFetcher(server *httptest.Server, queueSize int, pullBatch int) *Fetcher {
+	return &Fetcher{
+		taskQueue:      make(chan types.TaskPack, queueSize),
+		quitChan:       make(chan bool),
+		scheduler_addr: strings.TrimPrefix(server.URL, "http://"),
+		scheduler_api:  map[string]string{"pull": "/pull/tasks"},
+		httpClient:     &lib.HttpClient{},
+		advertiseAddr:  "fetcher-1:9191",
+		pullBatch:      pullBatch,
+		pullInterval:   10 * time.Millisecond}
+}
+
+//拉取的任务放入队列，请求带上max和fetcher地址
+func TestPullOnceEnqueue(t *testing.T) {
+	stub := &pullStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	fetcher := newPullFetcher(server, 3, 3)
+
+	if n := fetcher.pullOnce(2); n != 2 {
+		t.Fatal("expect 2 pulled tasks, got ", n)
+	}
+	if len(fetcher.taskQueue) != 2 {
+		t.Fatal("expect 2 tasks in queue, got ", len(fetcher.taskQueue))
+	}
+	pack := <-fetcher.taskQueue
+	if pack.TaskId != 1 || pack.Domain != "fetcher-1:9191" {
+		t.Error("unexpected task: ", pack)
+	}
+}
+
+//队列满后不再拉取，队列有空位时只拉取空位数
+func TestPullTasksBackPressure(t *testing.T) {
+	stub := &pullStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	fetcher := newPullFetcher(server, 3, 2)
+	go fetcher.pullTasks()
+	defer close(fetcher.quitChan)
+
+	waitRequests := func(n int) []int {
+		deadline := time.Now().Add(2 * time.Second)
+		for len(stub.requests()) < n && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		//再等几个pullInterval，确认没有多余的请求
+		time.Sleep(50 * time.Millisecond)
+		return stub.requests()
+	}
+	if maxes := waitRequests(2); len(maxes) != 2 || maxes[0] != 2 || maxes[1] != 1 {
+		t.Fatal("expect pulls of 2 and 1 tasks until queue is full, got ", maxes)
+	}
+	<-fetcher.taskQueue
+	if maxes := waitRequests(3); len(maxes) != 3 || maxes[2] != 1 {
+		t.Fatal("expect one more pull of 1 task, got ", maxes)
+	}
+}
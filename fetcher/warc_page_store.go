@@ -0,0 +1,636 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//WARC中时间戳的格式
+const (
+	warcDateFormat = "2006-01-02T15:04:05Z"
+	cdxDateFormat  = "20060102150405"
+	cdxHeader      = " CDX N b a m s k r M S V g"
+)
+
+//以gzip压缩的WARC/1.1格式保存页面，每个记录单独压缩成一个gzip member；
+//每次抓取写入request, response, metadata三个记录，文件超过maxSize后切换到新文件；
+//每个WARC文件旁边有同名的.cdx索引，写入时按抓取顺序追加，文件切换或关闭时按SURT排序；key为 "<文件名>:<response记录的偏移>"
+type WarcPageStore struct {
+	dir      string
+	prefix   string
+	maxSize  int64
+	lock     sync.Mutex
+	file     *os.File
+	fileName string
+	size     int64
+	seq      int
+	index    map[string][]warcCapture //url -> 按版本排序的抓取记录
+}
+
+//索引中的一次抓取
+type warcCapture struct {
+	version  int64
+	fileName string
+	offset   int64
+}
+
+//解析出的WARC记录
+type warcRecord struct {
+	headers map[string]string
+	block   []byte
+}
+
+func InitWarcPageStore(dir string, prefix string, maxSize int64) (*WarcPageStore, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = "crawler"
+	}
+	store := &WarcPageStore{dir: dir, prefix: prefix, maxSize: maxSize, index: map[string][]warcCapture{}}
+	err = store.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (this *WarcPageStore) Save(domain string, urlpath string, page []byte, meta types.PageMeta) (string, error) {
+	targetUri := domain + urlpath
+	if meta.FetchTime == 0 {
+		meta.FetchTime = time.Now().Unix()
+	}
+	fetchTime := time.Unix(meta.FetchTime, 0).UTC()
+	metaData, err := marshalMeta(meta)
+	if err != nil {
+		return "", err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	err = this.rotate()
+	if err != nil {
+		log.Errorln("open warc file in ", this.dir, " error: ", err)
+		return "", err
+	}
+	//任何一步失败都截断到写入前的位置，不留下不完整的抓取
+	start := this.size
+
+	responseId := newWarcRecordId()
+	_, _, err = this.writeRecord([][2]string{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", newWarcRecordId()},
+		{"WARC-Date", fetchTime.Format(warcDateFormat)},
+		{"WARC-Target-URI", targetUri},
+		{"WARC-Concurrent-To", responseId},
+		{"Content-Type", "application/http;msgtype=request"}}, warcRequestBlock(targetUri))
+	if err != nil {
+		log.Errorln("write warc request record of ", targetUri, " error: ", err)
+		this.truncate(start)
+		return "", err
+	}
+
+	payloadDigest := warcDigest(page)
+	offset, length, err := this.writeRecord([][2]string{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", responseId},
+		{"WARC-Date", fetchTime.Format(warcDateFormat)},
+		{"WARC-Target-URI", targetUri},
+		{"WARC-Payload-Digest", payloadDigest},
+		{"Content-Type", "application/http;msgtype=response"}}, warcResponseBlock(page, meta))
+	if err != nil {
+		log.Errorln("write warc response record of ", targetUri, " error: ", err)
+		this.truncate(start)
+		return "", err
+	}
+
+	_, _, err = this.writeRecord([][2]string{
+		{"WARC-Type", "metadata"},
+		{"WARC-Record-ID", newWarcRecordId()},
+		{"WARC-Date", fetchTime.Format(warcDateFormat)},
+		{"WARC-Target-URI", targetUri},
+		{"WARC-Refers-To", responseId},
+		{"Content-Type", "application/json"}}, metaData)
+	if err != nil {
+		log.Errorln("write warc metadata record of ", targetUri, " error: ", err)
+		this.truncate(start)
+		return "", err
+	}
+
+	capture := warcCapture{version: meta.FetchTime, fileName: this.fileName, offset: offset}
+	err = this.appendCdx(capture, targetUri, meta, payloadDigest, length)
+	if err != nil {
+		log.Errorln("write cdx of ", targetUri, " error: ", err)
+		this.truncate(start)
+		return "", err
+	}
+	this.addCapture(targetUri, capture)
+	return warcKey(this.fileName, offset), nil
+}
+
+//抽取结果保存为resource记录，指向该页面最近一次的response记录
+func (this *WarcPageStore) SaveExtracted(domain string, urlpath string, data []byte) (string, error) {
+	targetUri := domain + urlpath
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	err := this.rotate()
+	if err != nil {
+		log.Errorln("open warc file in ", this.dir, " error: ", err)
+		return "", err
+	}
+	headers := [][2]string{
+		{"WARC-Type", "resource"},
+		{"WARC-Record-ID", newWarcRecordId()},
+		{"WARC-Date", time.Now().UTC().Format(warcDateFormat)},
+		{"WARC-Target-URI", "urn:x-crawler:extracted:" + targetUri},
+		{"Content-Type", "application/json"}}
+	if len(this.index[cdxEscape(targetUri)]) > 0 {
+		headers = append(headers, [2]string{"WARC-Refers-To-Target-URI", targetUri})
+	}
+	offset, _, err := this.writeRecord(headers, data)
+	if err != nil {
+		log.Errorln("save extracted data: "+targetUri+" error:", err)
+		return "", err
+	}
+	return warcKey(this.fileName, offset), nil
+}
+
+//response记录返回http body，其他记录返回记录内容
+func (this *WarcPageStore) Load(key string) ([]byte, error) {
+	records, err := this.readRecords(key, 1)
+	if err != nil {
+		return nil, err
+	}
+	record := records[0]
+	if record.headers["WARC-Type"] == "response" {
+		return warcHttpBody(record.block), nil
+	}
+	return record.block, nil
+}
+
+//metadata记录紧跟在response记录之后
+func (this *WarcPageStore) LoadMeta(key string) (types.PageMeta, error) {
+	records, err := this.readRecords(key, 2)
+	if err != nil {
+		return types.PageMeta{}, err
+	}
+	if records[0].headers["WARC-Type"] != "response" || records[1].headers["WARC-Type"] != "metadata" {
+		return types.PageMeta{}, errors.New("no metadata record for warc key: " + key)
+	}
+	return unmarshalMeta(records[1].block)
+}
+
+func (this *WarcPageStore) Get(domain string, urlpath string, version int64) ([]byte, error) {
+	captures := this.captures(domain + urlpath)
+	for i := len(captures) - 1; i >= 0; i-- {
+		if captures[i].version == version {
+			return this.Load(warcKey(captures[i].fileName, captures[i].offset))
+		}
+	}
+	return nil, ErrPageNotFound
+}
+
+func (this *WarcPageStore) ListVersions(domain string, urlpath string) ([]int64, error) {
+	versions := []int64{}
+	for _, capture := range this.captures(domain + urlpath) {
+		if len(versions) == 0 || versions[len(versions)-1] != capture.version {
+			versions = append(versions, capture.version)
+		}
+	}
+	return versions, nil
+}
+
+func (this *WarcPageStore) Latest(domain string, urlpath string) (int64, []byte, error) {
+	captures := this.captures(domain + urlpath)
+	if len(captures) == 0 {
+		return 0, nil, ErrPageNotFound
+	}
+	latest := captures[len(captures)-1]
+	page, err := this.Load(warcKey(latest.fileName, latest.offset))
+	return latest.version, page, err
+}
+
+func (this *WarcPageStore) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.file == nil {
+		return nil
+	}
+	return this.closeFile()
+}
+
+//关闭当前文件，并把它的CDX按SURT排序
+func (this *WarcPageStore) closeFile() error {
+	err := this.file.Close()
+	this.file = nil
+	sortErr := sortCdx(filepath.Join(this.dir, this.fileName+".cdx"))
+	if sortErr != nil {
+		log.Errorln("sort cdx of ", this.fileName, " error: ", sortErr)
+		if err == nil {
+			err = sortErr
+		}
+	}
+	return err
+}
+
+//当前文件超过maxSize时关闭，并打开新文件写入warcinfo记录
+func (this *WarcPageStore) rotate() error {
+	if this.file != nil && (this.maxSize <= 0 || this.size < this.maxSize) {
+		return nil
+	}
+	if this.file != nil {
+		this.closeFile()
+	}
+	var fileName string
+	for {
+		this.seq++
+		fileName = fmt.Sprintf("%s-%s-%05d.warc.gz", this.prefix, time.Now().UTC().Format(cdxDateFormat), this.seq)
+		if _, err := os.Stat(filepath.Join(this.dir, fileName)); os.IsNotExist(err) {
+			break
+		}
+	}
+	file, err := os.OpenFile(filepath.Join(this.dir, fileName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(this.dir, fileName+".cdx"), []byte(cdxHeader+"\n"), 0666)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	this.file = file
+	this.fileName = fileName
+	this.size = 0
+	log.Infoln("start new warc file: ", fileName)
+
+	info := "software: github.com/zhaozhi406/crawler\r\nformat: WARC File Format 1.1\r\nconformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n"
+	_, _, err = this.writeRecord([][2]string{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", newWarcRecordId()},
+		{"WARC-Date", time.Now().UTC().Format(warcDateFormat)},
+		{"WARC-Filename", fileName},
+		{"Content-Type", "application/warc-fields"}}, []byte(info))
+	if err != nil && this.file != nil {
+		//没有warcinfo的文件不再使用，下次写入时切换到新文件
+		this.closeFile()
+	}
+	return err
+}
+
+//写入一个gzip压缩的记录，返回记录在文件中的偏移和压缩后的长度
+func (this *WarcPageStore) writeRecord(headers [][2]string, block []byte) (int64, int64, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	fmt.Fprint(gz, "WARC/1.1\r\n")
+	for _, header := range headers {
+		fmt.Fprintf(gz, "%s: %s\r\n", header[0], header[1])
+	}
+	fmt.Fprintf(gz, "WARC-Block-Digest: %s\r\n", warcDigest(block))
+	fmt.Fprintf(gz, "Content-Length: %d\r\n\r\n", len(block))
+	gz.Write(block)
+	gz.Write([]byte("\r\n\r\n"))
+	err := gz.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	offset := this.size
+	n, err := this.file.Write(buf.Bytes())
+	if err != nil {
+		//去掉写了一半的gzip member
+		this.truncate(offset)
+		return 0, 0, err
+	}
+	this.size += int64(n)
+	return offset, int64(n), nil
+}
+
+//把当前文件截断到offset，丢弃写入失败的记录；截断失败时关闭文件，下次写入时切换到新文件
+func (this *WarcPageStore) truncate(offset int64) {
+	if this.file == nil {
+		return
+	}
+	err := this.file.Truncate(offset)
+	if err == nil {
+		_, err = this.file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Errorln("truncate warc file ", this.fileName, " to ", offset, " error: ", err, ", switch to a new file.")
+		this.closeFile()
+		return
+	}
+	this.size = offset
+}
+
+//从key指向的位置开始读取n个记录
+func (this *WarcPageStore) readRecords(key string, n int) ([]warcRecord, error) {
+	fileName, offset, err := parseWarcKey(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filepath.Join(this.dir, fileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrPageNotFound
+		}
+		return nil, err
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	records := []warcRecord{}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			err = gz.Reset(reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		gz.Multistream(false)
+		record, err := readWarcRecord(bufio.NewReader(gz))
+		if err != nil {
+			return nil, err
+		}
+		//读完当前member，使reader停在下一个member的开头
+		io.Copy(ioutil.Discard, gz)
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func readWarcRecord(reader *bufio.Reader) (warcRecord, error) {
+	record := warcRecord{headers: map[string]string{}}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return record, err
+	}
+	if !strings.HasPrefix(line, "WARC/") {
+		return record, errors.New("not a warc record: " + strings.TrimSpace(line))
+	}
+	for {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return record, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		pos := strings.Index(line, ":")
+		if pos > 0 {
+			record.headers[line[:pos]] = strings.TrimSpace(line[pos+1:])
+		}
+	}
+	length, err := strconv.ParseInt(record.headers["Content-Length"], 10, 64)
+	if err != nil {
+		return record, errors.New("bad warc Content-Length: " + record.headers["Content-Length"])
+	}
+	record.block = make([]byte, length)
+	_, err = io.ReadFull(reader, record.block)
+	return record, err
+}
+
+//追加一行CDX索引：N b a m s k r M S V g
+func (this *WarcPageStore) appendCdx(capture warcCapture, targetUri string, meta types.PageMeta, digest string, length int64) error {
+	mimeType, _, err := mime.ParseMediaType(meta.ContentType)
+	if err != nil || mimeType == "" {
+		mimeType = "unk"
+	}
+	status := "-"
+	if meta.StatusCode > 0 {
+		status = strconv.Itoa(meta.StatusCode)
+	}
+	line := strings.Join([]string{
+		surtUrl(targetUri),
+		time.Unix(capture.version, 0).UTC().Format(cdxDateFormat),
+		cdxEscape(targetUri),
+		mimeType,
+		status,
+		strings.TrimPrefix(digest, "sha1:"),
+		"-",
+		"-",
+		strconv.FormatInt(length, 10),
+		strconv.FormatInt(capture.offset, 10),
+		capture.fileName}, " ")
+	file, err := os.OpenFile(filepath.Join(this.dir, this.fileName+".cdx"), os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(line + "\n")
+	if err != nil {
+		//去掉写了一半的行，避免和下一行连在一起
+		file.Truncate(info.Size())
+	}
+	return err
+}
+
+//CDX按行的字节序排序（与LC_ALL=C sort一致），即先按SURT再按时间戳；已有序时不重写
+func sortCdx(cdxFile string) error {
+	data, err := ioutil.ReadFile(cdxFile)
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" && line != cdxHeader {
+			lines = append(lines, line)
+		}
+	}
+	if sort.StringsAreSorted(lines) {
+		return nil
+	}
+	sort.Strings(lines)
+	//先写临时文件再改名，排序中途失败不会损坏原来的索引
+	tmpFile := cdxFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, []byte(cdxHeader+"\n"+strings.Join(lines, "\n")+"\n"), 0666)
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, cdxFile)
+}
+
+//启动时从已有的.cdx文件恢复索引；上次没有正常关闭的文件的CDX在这里补上排序
+func (this *WarcPageStore) loadIndex() error {
+	cdxFiles, err := filepath.Glob(filepath.Join(this.dir, "*.cdx"))
+	if err != nil {
+		return err
+	}
+	for _, cdxFile := range cdxFiles {
+		if err = sortCdx(cdxFile); err != nil {
+			log.Errorln("sort cdx ", cdxFile, " error: ", err)
+		}
+		data, err := ioutil.ReadFile(cdxFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Split(line, " ")
+			if len(fields) != 11 {
+				continue
+			}
+			fetchTime, err1 := time.Parse(cdxDateFormat, fields[1])
+			offset, err2 := strconv.ParseInt(fields[9], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			this.addCapture(fields[2], warcCapture{version: fetchTime.Unix(), fileName: fields[10], offset: offset})
+		}
+	}
+	for _, captures := range this.index {
+		sort.SliceStable(captures, func(i, j int) bool { return captures[i].version < captures[j].version })
+	}
+	return nil
+}
+
+//索引以CDX中的a字段为key
+func (this *WarcPageStore) addCapture(targetUri string, capture warcCapture) {
+	key := cdxEscape(targetUri)
+	this.index[key] = append(this.index[key], capture)
+}
+
+func (this *WarcPageStore) captures(targetUri string) []warcCapture {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.index[cdxEscape(targetUri)]
+}
+
+func warcKey(fileName string, offset int64) string {
+	return fileName + ":" + strconv.FormatInt(offset, 10)
+}
+
+func parseWarcKey(key string) (string, int64, error) {
+	pos := strings.LastIndex(key, ":")
+	if pos <= 0 {
+		return "", 0, errors.New("bad warc key: " + key)
+	}
+	fileName := key[:pos]
+	if strings.ContainsAny(fileName, "/\\") {
+		return "", 0, errors.New("bad warc key: " + key)
+	}
+	offset, err := strconv.ParseInt(key[pos+1:], 10, 64)
+	if err != nil {
+		return "", 0, errors.New("bad warc key: " + key)
+	}
+	return fileName, offset, nil
+}
+
+func newWarcRecordId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func warcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+//没有保存原始请求，按抓取时的方式还原一个GET请求
+func warcRequestBlock(targetUri string) []byte {
+	requestUri := "/"
+	host := targetUri
+	if u, err := url.Parse(targetUri); err == nil {
+		requestUri = u.RequestURI()
+		host = u.Host
+	}
+	return []byte(fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", requestUri, host))
+}
+
+//保存的页面已解压并转为utf-8，因此去掉Content-Encoding等头，并修正Content-Length和charset；
+//原始的Content-Type保存在metadata记录中
+func warcResponseBlock(page []byte, meta types.PageMeta) []byte {
+	statusCode := meta.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	header := http.Header{}
+	for key, values := range meta.Headers {
+		header[key] = values
+	}
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(page)))
+	if meta.ContentType != "" {
+		if mimeType, params, err := mime.ParseMediaType(meta.ContentType); err == nil && params["charset"] != "" {
+			params["charset"] = "utf-8"
+			header.Set("Content-Type", mime.FormatMediaType(mimeType, params))
+		}
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(page)
+	return buf.Bytes()
+}
+
+func warcHttpBody(block []byte) []byte {
+	pos := bytes.Index(block, []byte("\r\n\r\n"))
+	if pos < 0 {
+		return block
+	}
+	return block[pos+4:]
+}
+
+//CDX的N字段：host按段倒序，去掉www.，例如 com,example)/path?q=1
+func surtUrl(targetUri string) string {
+	u, err := url.Parse(targetUri)
+	if err != nil || u.Host == "" {
+		return cdxEscape(strings.ToLower(targetUri))
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	parts := strings.Split(host, ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	surt := strings.Join(parts, ",")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		surt += ":" + port
+	}
+	return cdxEscape(surt + ")" + strings.ToLower(u.RequestURI()))
+}
+
+//CDX以空格分隔字段，url中的空格需要转义
+func cdxEscape(s string) string {
+	return strings.Replace(s, " ", "%20", -1)
+}
@@ -0,0 +1,177 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//保存页面到seaweedfs：先向master申请file id，再上传到对应的volume server；
+//返回的key为 "<volume地址>/<fid>"，可直接拼成下载地址；
+//页面申请两个连续的fid，元数据保存在 "<fid>_1"
+type WeedPageStore struct {
+	master      string
+	collection  string
+	replication string
+	httpClient  *lib.HttpClient
+}
+
+type weedAssignResult struct {
+	Fid       string `json:"fid"`
+	Url       string `json:"url"`
+	PublicUrl string `json:"publicUrl"`
+	Count     int    `json:"count"`
+	Error     string `json:"error"`
+}
+
+type weedUploadResult struct {
+	Name  string `json:"name"`
+	Size  int    `json:"size"`
+	Error string `json:"error"`
+}
+
+//httpClient为空时使用默认超时设置的客户端
+func InitWeedPageStore(master string, collection string, replication string, httpClient *lib.HttpClient) *WeedPageStore {
+	master = strings.TrimSuffix(master, "/")
+	if !strings.HasPrefix(master, "http://") && !strings.HasPrefix(master, "https://") {
+		master = "http://" + master
+	}
+	if httpClient == nil {
+		httpClient = lib.InitHttpClient(map[string]string{})
+	}
+	return &WeedPageStore{master: master, collection: collection, replication: replication, httpClient: httpClient}
+}
+
+func (this *WeedPageStore) Save(domain string, urlpath string, page []byte, meta types.PageMeta) (string, error) {
+	metaData, err := marshalMeta(meta)
+	if err != nil {
+		return "", err
+	}
+	assign, err := this.assign(2)
+	if err == nil {
+		err = this.uploadTo(assign.Url, assign.Fid+"_1", "meta.json", metaData)
+	}
+	if err == nil {
+		err = this.uploadTo(assign.Url, assign.Fid, "page.html", page)
+	}
+	key := ""
+	if err == nil {
+		key = assign.Url + "/" + assign.Fid
+	} else {
+		log.Errorln("save page: "+domain+urlpath+" to weedfs error:", err)
+	}
+	return key, err
+}
+
+func (this *WeedPageStore) SaveExtracted(domain string, urlpath string, data []byte) (string, error) {
+	key, err := this.upload("extracted.json", data)
+	if err != nil {
+		log.Errorln("save extracted data: "+domain+urlpath+" to weedfs error:", err)
+	}
+	return key, err
+}
+
+//key即 "<volume地址>/<fid>"
+func (this *WeedPageStore) Load(key string) ([]byte, error) {
+	status, body, err := this.httpClient.GetStatus("http://" + key)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("weedfs get %s status: %d", key, status)
+	}
+	return body, nil
+}
+
+//seaweedfs只能按fid读取，不保存domain, urlpath到版本的索引
+func (this *WeedPageStore) LoadMeta(key string) (types.PageMeta, error) {
+	data, err := this.Load(key + "_1")
+	if err != nil {
+		return types.PageMeta{}, err
+	}
+	return unmarshalMeta(data)
+}
+
+func (this *WeedPageStore) Get(domain string, urlpath string, version int64) ([]byte, error) {
+	return nil, ErrVersionsNotSupported
+}
+
+func (this *WeedPageStore) ListVersions(domain string, urlpath string) ([]int64, error) {
+	return nil, ErrVersionsNotSupported
+}
+
+func (this *WeedPageStore) Latest(domain string, urlpath string) (int64, []byte, error) {
+	return 0, nil, ErrVersionsNotSupported
+}
+
+func (this *WeedPageStore) upload(fileName string, data []byte) (string, error) {
+	assign, err := this.assign(1)
+	if err != nil {
+		return "", err
+	}
+	err = this.uploadTo(assign.Url, assign.Fid, fileName, data)
+	if err != nil {
+		return "", err
+	}
+	return assign.Url + "/" + assign.Fid, nil
+}
+
+func (this *WeedPageStore) uploadTo(volumeUrl string, fid string, fileName string, data []byte) error {
+	uploadUrl := fmt.Sprintf("http://%s/%s", volumeUrl, fid)
+	res, err := this.httpClient.Upload(uploadUrl, "file", fileName, data)
+	if err != nil {
+		return err
+	}
+	result := weedUploadResult{}
+	err = json.Unmarshal(res, &result)
+	if err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return errors.New("weedfs upload error: " + result.Error)
+	}
+	log.Debugln("upload ", fileName, " to ", uploadUrl, ", size: ", result.Size)
+	return nil
+}
+
+//向master申请count个连续的file id，第i个（从0开始）为 "<fid>_i"
+func (this *WeedPageStore) assign(count int) (weedAssignResult, error) {
+	result := weedAssignResult{}
+	param := url.Values{}
+	if count > 1 {
+		param.Add("count", strconv.Itoa(count))
+	}
+	if this.collection != "" {
+		param.Add("collection", this.collection)
+	}
+	if this.replication != "" {
+		param.Add("replication", this.replication)
+	}
+	assignUrl := this.master + "/dir/assign"
+	if len(param) > 0 {
+		assignUrl += "?" + param.Encode()
+	}
+	res, err := this.httpClient.Get(assignUrl)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(res, &result)
+	if err != nil {
+		return result, err
+	}
+	if result.Error != "" {
+		return result, errors.New("weedfs assign error: " + result.Error)
+	}
+	if result.Fid == "" || result.Url == "" {
+		return result, errors.New("weedfs assign returns no fid: " + string(res))
+	}
+	return result, nil
+}
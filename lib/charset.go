@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+//查找<meta>声明时最多扫描的字节数
+const metaScanBytes = 4096
+
+//内容探测时尝试的编码，覆盖中文和日文站点常用的编码
+var sniffEncodings = []string{"gb18030", "big5", "shift_jis", "euc-jp", "euc-kr"}
+
+//把html转为utf-8，返回转换后的内容和识别出的编码名；
+//编码依次从Content-Type、BOM、<meta>标签、内容探测中确定
+func (this *HttpClient) DecodeHtml(html []byte, contentType string) ([]byte, string, error) {
+	enc, name := DetectCharset(html, contentType)
+	if name == "utf-8" {
+		//去掉BOM
+		return bytes.TrimPrefix(html, []byte("\xef\xbb\xbf")), name, nil
+	}
+	decoded, _, err := transform.Bytes(enc.NewDecoder(), html)
+	if err != nil {
+		return html, name, err
+	}
+	return decoded, name, nil
+}
+
+func DetectCharset(html []byte, contentType string) (encoding.Encoding, string) {
+	//Content-Type header
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if enc, name := lookupEncoding(params["charset"]); enc != nil {
+			return enc, name
+		}
+	}
+
+	//BOM
+	switch {
+	case bytes.HasPrefix(html, []byte("\xef\xbb\xbf")):
+		return unicode.UTF8, "utf-8"
+	case bytes.HasPrefix(html, []byte("\xfe\xff")):
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), "utf-16be"
+	case bytes.HasPrefix(html, []byte("\xff\xfe")):
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), "utf-16le"
+	}
+
+	//<meta charset> 或 <meta http-equiv="Content-Type">
+	if enc, name := lookupEncoding(metaCharset(html)); enc != nil {
+		return enc, name
+	}
+
+	return sniffCharset(html)
+}
+
+func lookupEncoding(label string) (encoding.Encoding, string) {
+	label = strings.Trim(strings.TrimSpace(label), `"'`)
+	if label == "" {
+		return nil, ""
+	}
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, ""
+	}
+	name, err := htmlindex.Name(enc)
+	if err != nil {
+		return nil, ""
+	}
+	return enc, name
+}
+
+//在<head>中查找meta声明的编码，只看前metaScanBytes字节
+func metaCharset(page []byte) string {
+	if len(page) > metaScanBytes {
+		page = page[:metaScanBytes]
+	}
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	for {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			return ""
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data == "body" {
+			return ""
+		}
+		if token.Data != "meta" {
+			continue
+		}
+		httpEquiv := ""
+		content := ""
+		for _, attr := range token.Attr {
+			switch strings.ToLower(attr.Key) {
+			case "charset":
+				return attr.Val
+			case "http-equiv":
+				httpEquiv = strings.ToLower(attr.Val)
+			case "content":
+				content = attr.Val
+			}
+		}
+		if httpEquiv == "content-type" {
+			if _, params, err := mime.ParseMediaType(content); err == nil && params["charset"] != "" {
+				return params["charset"]
+			}
+		}
+	}
+}
+
+//合法的utf-8直接认定；否则用候选编码逐个解码，取得分最高的
+func sniffCharset(html []byte) (encoding.Encoding, string) {
+	if utf8.Valid(html) {
+		return unicode.UTF8, "utf-8"
+	}
+
+	var best encoding.Encoding
+	bestName := ""
+	bestScore := 0
+	for _, label := range sniffEncodings {
+		enc, name := lookupEncoding(label)
+		if enc == nil {
+			continue
+		}
+		decoded, _, err := transform.Bytes(enc.NewDecoder(), html)
+		if err != nil {
+			continue
+		}
+		score := scoreDecoded(decoded, name == "shift_jis" || name == "euc-jp")
+		if best == nil || score > bestScore {
+			best, bestName, bestScore = enc, name, score
+		}
+	}
+	if best == nil || bestScore <= 0 {
+		enc, name := lookupEncoding("windows-1252")
+		return enc, name
+	}
+	return best, bestName
+}
+
+//按解码后字符的常见程度打分：常用汉字、韩文加分，无效字符、私用区、半角片假名等罕见字符减分；
+//假名只在按日文编码解码时加分，大量假名出现在中文编码的结果里是不合理的
+func scoreDecoded(decoded []byte, japanese bool) int {
+	score := 0
+	for _, r := range string(decoded) {
+		switch {
+		case r < 0x80:
+		case r == utf8.RuneError:
+			score -= 50
+		case r >= 0x3040 && r <= 0x30ff: //平假名、片假名
+			if japanese {
+				score += 3
+			} else {
+				score -= 1
+			}
+		case r >= 0x4e00 && r <= 0x9fff: //常用汉字
+			score += 2
+		case r >= 0xac00 && r <= 0xd7a3: //韩文
+			score += 2
+		case r >= 0x3000 && r <= 0x303f, r >= 0xff01 && r <= 0xff5e: //全角标点
+			score += 1
+		case r >= 0xff61 && r <= 0xff9f: //半角片假名
+			score -= 5
+		case r >= 0xe000 && r <= 0xf8ff, r >= 0x3400 && r <= 0x4dbf: //私用区、扩展A区汉字
+			score -= 5
+		default:
+			score -= 1
+		}
+	}
+	return score
+}
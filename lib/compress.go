@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//支持的压缩方式，空字符串为不压缩
+const (
+	COMPRESSION_NONE = ""
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+var ErrUnknownCompression = errors.New("unknown compression")
+
+//压缩后文件名的后缀
+func CompressionExt(compression string) string {
+	switch compression {
+	case COMPRESSION_GZIP:
+		return ".gz"
+	case COMPRESSION_ZSTD:
+		return ".zst"
+	}
+	return ""
+}
+
+//根据文件名后缀判断压缩方式
+func CompressionOfFile(fname string) string {
+	switch {
+	case len(fname) > 3 && fname[len(fname)-3:] == ".gz":
+		return COMPRESSION_GZIP
+	case len(fname) > 4 && fname[len(fname)-4:] == ".zst":
+		return COMPRESSION_ZSTD
+	}
+	return COMPRESSION_NONE
+}
+
+func Compress(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		return data, nil
+	case COMPRESSION_GZIP:
+		buf := &bytes.Buffer{}
+		writer := gzip.NewWriter(buf)
+		_, err := writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+		return buf.Bytes(), err
+	case COMPRESSION_ZSTD:
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(data, nil), nil
+	}
+	return nil, ErrUnknownCompression
+}
+
+func Decompress(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		return data, nil
+	case COMPRESSION_GZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case COMPRESSION_ZSTD:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(data, nil)
+	}
+	return nil, ErrUnknownCompression
+}
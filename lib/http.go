@@ -1,71 +1,310 @@
 package lib
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/qiniu/iconv"
+	"github.com/zhaozhi406/crawler/types"
 )
 
+//可配置的http客户端，零值可直接使用（等同于http.DefaultClient，不限制body大小）
 type HttpClient struct {
+	client         *http.Client
+	userAgent      string
+	defaultHeaders map[string]string
+	maxBodyBytes   int64
+}
+
+//body超过maxBodyBytes时返回
+var ErrBodyTooLarge = errors.New("response body too large")
+
+//根据配置创建http客户端，配置项（时间单位为秒）：
+//connect_timeout, read_timeout（等待响应头）, total_timeout, user_agent, default_headers（json）,
+//max_body_bytes, max_redirects, max_idle_conns, max_idle_conns_per_host, idle_conn_timeout
+func InitHttpClient(config map[string]string) *HttpClient {
+	connectTimeout := configSeconds(config, "connect_timeout", 10)
+	readTimeout := configSeconds(config, "read_timeout", 30)
+	totalTimeout := configSeconds(config, "total_timeout", 60)
+	idleConnTimeout := configSeconds(config, "idle_conn_timeout", 90)
+	maxRedirects := configInt(config, "max_redirects", 10)
+	maxIdleConns := configInt(config, "max_idle_conns", 100)
+	maxIdleConnsPerHost := configInt(config, "max_idle_conns_per_host", 2)
+	maxBodyBytes := int64(configInt(config, "max_body_bytes", 0))
+	defaultHeaders := map[string]string{}
+	json.Unmarshal([]byte(config["default_headers"]), &defaultHeaders)
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   totalTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		}}
+
+	return &HttpClient{client: client, userAgent: config["user_agent"], defaultHeaders: defaultHeaders, maxBodyBytes: maxBodyBytes}
+}
+
+func configSeconds(config map[string]string, key string, def int) time.Duration {
+	return time.Duration(configInt(config, key, def)) * time.Second
+}
+
+func configInt(config map[string]string, key string, def int) int {
+	val, err := strconv.Atoi(config[key])
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+//补上默认header和User-Agent后发送请求
+func (this *HttpClient) do(req *http.Request) (*http.Response, error) {
+	for key, val := range this.defaultHeaders {
+		if req.Header.Get(key) == "" {
+			req.Header.Set(key, val)
+		}
+	}
+	if this.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", this.userAgent)
+	}
+	client := this.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+//读取body，超过maxBodyBytes时返回已读取的部分和ErrBodyTooLarge
+func (this *HttpClient) readBody(resp *http.Response) ([]byte, error) {
+	if this.maxBodyBytes <= 0 {
+		return ioutil.ReadAll(resp.Body)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, this.maxBodyBytes+1))
+	if err == nil && int64(len(body)) > this.maxBodyBytes {
+		return body[:this.maxBodyBytes], ErrBodyTooLarge
+	}
+	return body, err
+}
+
+func (this *HttpClient) send(method string, destUrl string, contentType string, data io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, destUrl, data)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return this.do(req)
+}
+
+//发送调用方构造好的请求（例如需要签名的请求），返回状态码、响应头和body
+func (this *HttpClient) DoRequest(req *http.Request) (int, http.Header, []byte, error) {
+	resp, err := this.do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := this.readBody(resp)
+	return resp.StatusCode, resp.Header, body, err
+}
+
+//一次抓取的详细结果
+type FetchResponse struct {
+	StatusCode   int
+	FinalUrl     string //跟随跳转后的最终地址
+	ContentType  string
+	Header       http.Header
+	Body         []byte
+	Latency      time.Duration
+	Etag         string
+	LastModified string
+}
+
+//http状态码表示失败（>=400）
+type HttpStatusError struct {
+	StatusCode int
+}
+
+func (this *HttpStatusError) Error() string {
+	return fmt.Sprintf("http status %d", this.StatusCode)
+}
+
+//抓取url并返回状态码、最终地址等信息；状态码>=400时同时返回HttpStatusError；
+//headers为本次请求额外的header，例如条件请求的If-None-Match
+func (this *HttpClient) Fetch(url string, headers map[string]string) (*FetchResponse, error) {
+	start := time.Now()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return &FetchResponse{FinalUrl: url}, err
+	}
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	resp, err := this.do(req)
+	if err != nil {
+		return &FetchResponse{FinalUrl: url, Latency: time.Since(start)}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := this.readBody(resp)
+	fetchResp := &FetchResponse{
+		StatusCode:   resp.StatusCode,
+		FinalUrl:     resp.Request.URL.String(),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Header:       resp.Header,
+		Body:         body,
+		Latency:      time.Since(start),
+		Etag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified")}
+	if err == nil && resp.StatusCode >= 400 {
+		err = &HttpStatusError{StatusCode: resp.StatusCode}
+	}
+	return fetchResp, err
+}
+
+//把抓取错误归类，用于scheduler决定是否重试
+func ClassifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if err == ErrBodyTooLarge {
+		return types.ERR_CLASS_TOO_LARGE
+	}
+	var statusErr *HttpStatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode >= 500 {
+			return types.ERR_CLASS_5XX
+		}
+		return types.ERR_CLASS_4XX
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return types.ERR_CLASS_DNS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return types.ERR_CLASS_TIMEOUT
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return types.ERR_CLASS_CONNECT
+	}
+	return types.ERR_CLASS_OTHER
 }
 
 func (this *HttpClient) Get(url string) ([]byte, error) {
 
-	resp, err := http.Get(url)
+	resp, err := this.send("GET", url, "", nil)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := this.readBody(resp)
 	return body, err
 }
 
+//同Get，但同时返回http状态码
+func (this *HttpClient) GetStatus(url string) (int, []byte, error) {
+
+	resp, err := this.send("GET", url, "", nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := this.readBody(resp)
+	return resp.StatusCode, body, err
+}
+
 func (this *HttpClient) Post(url string, params url.Values) ([]byte, error) {
-	resp, err := http.PostForm(url, params)
+	resp, err := this.send("POST", url, "application/x-www-form-urlencoded", strings.NewReader(params.Encode()))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := this.readBody(resp)
 	return body, err
 
 }
 
-func (this *HttpClient) EncodeQuery(params map[string]string) string {
-	v := url.Values{}
-	for key, val := range params {
-		v.Add(key, val)
+//以multipart/form-data上传单个文件
+func (this *HttpClient) Upload(url string, fieldName string, fileName string, data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	part, err := writer.CreateFormFile(fieldName, fileName)
+	if err != nil {
+		return nil, err
 	}
-	return v.Encode()
+	_, err = part.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := this.send("POST", url, writer.FormDataContentType(), buf)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := this.readBody(resp)
+	return body, err
 }
 
-func (this *HttpClient) IconvHtml(html []byte, destEncoding string) ([]byte, error) {
+//以json为body发送post请求
+func (this *HttpClient) PostJson(url string, data []byte) ([]byte, error) {
+	resp, err := this.send("POST", url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	strReader := bytes.NewReader(html)
-	scanner := bufio.NewScanner(strReader)
-	re, err := regexp.Compile("charset=([\\w-]+)")
+	body, err := this.readBody(resp)
+	return body, err
+}
 
-	srcEncoding := ""
-	for scanner.Scan() {
-		matches := re.FindStringSubmatch(scanner.Text())
-		if matches != nil {
-			srcEncoding = matches[1]
-			break
-		}
+//同PostJson，但同时返回http状态码
+func (this *HttpClient) PostJsonStatus(url string, data []byte) (int, []byte, error) {
+	resp, err := this.send("POST", url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
 	}
+	defer resp.Body.Close()
+
+	body, err := this.readBody(resp)
+	return resp.StatusCode, body, err
+}
 
-	if srcEncoding != "" && srcEncoding != destEncoding {
-		codec, err := iconv.Open(destEncoding, srcEncoding)
-		defer codec.Close()
-		u8str := codec.ConvString(string(html))
-		return []byte(u8str), err
+func (this *HttpClient) EncodeQuery(params map[string]string) string {
+	v := url.Values{}
+	for key, val := range params {
+		v.Add(key, val)
 	}
-	return html, err
+	return v.Encode()
 }
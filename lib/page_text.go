@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+//取出html中的可见文本片段，忽略script和style，去掉空白片段
+func PageTexts(page []byte) []string {
+	texts := []string{}
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	skip := 0
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case html.ErrorToken:
+			return texts
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				text := strings.TrimSpace(string(tokenizer.Text()))
+				if text != "" {
+					texts = append(texts, text)
+				}
+			}
+		}
+	}
+}
+
+//比较新旧两组文本行，返回新增和删除的行（按出现次数计，不考虑顺序）
+func DiffLines(oldLines []string, newLines []string) ([]string, []string) {
+	counts := map[string]int{}
+	for _, line := range oldLines {
+		counts[line]++
+	}
+	added := []string{}
+	for _, line := range newLines {
+		if counts[line] > 0 {
+			counts[line]--
+		} else {
+			added = append(added, line)
+		}
+	}
+	//counts中剩下的是旧文本中未匹配的行
+	removed := []string{}
+	for _, line := range oldLines {
+		if counts[line] > 0 {
+			removed = append(removed, line)
+			counts[line]--
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"encoding/json"
+
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//共享队列的名字，所有fetcher从同一个list取任务
+const SharedTaskQueue = "shared"
+
+//基于redis list的任务队列：scheduler用LPUSH放入任务，fetcher用BRPOPLPUSH取出并同时放入自己的processing list，
+//处理完后从processing list删除；fetcher重启后把processing list中未完成的任务放回队列
+type RedisTaskQueue struct {
+	pool   *pool.Pool
+	prefix string
+}
+
+func InitRedisTaskQueue(pool *pool.Pool, prefix string) *RedisTaskQueue {
+	if prefix == "" {
+		prefix = "crawler:tasks"
+	}
+	return &RedisTaskQueue{pool: pool, prefix: prefix}
+}
+
+//任务队列的key，name为fetcher地址或SharedTaskQueue
+func (this *RedisTaskQueue) QueueKey(name string) string {
+	return this.prefix + ":" + name
+}
+
+//fetcher的processing list的key
+func (this *RedisTaskQueue) ProcessingKey(fetcher string) string {
+	return this.prefix + ":processing:" + fetcher
+}
+
+func (this *RedisTaskQueue) Push(queueKey string, taskPacks []types.TaskPack) error {
+	if len(taskPacks) == 0 {
+		return nil
+	}
+	args := []interface{}{queueKey}
+	for _, pack := range taskPacks {
+		jsonBytes, err := json.Marshal(pack)
+		if err != nil {
+			return err
+		}
+		args = append(args, jsonBytes)
+	}
+	return this.pool.Cmd("lpush", args...).Err
+}
+
+//阻塞最多timeout秒取出一个任务，同时放入processing list；超时返回nil；
+//返回的原始json用于Ack
+func (this *RedisTaskQueue) Pop(queueKey string, processingKey string, timeout int) (*types.TaskPack, []byte, error) {
+	client, err := this.pool.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer this.pool.Put(client)
+	resp := client.Cmd("brpoplpush", queueKey, processingKey, timeout)
+	if resp.IsType(redis.Nil) {
+		return nil, nil, nil
+	}
+	raw, err := resp.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	pack := &types.TaskPack{}
+	err = json.Unmarshal(raw, pack)
+	if err != nil {
+		//无法解析的任务直接丢弃，避免反复取到
+		this.Ack(processingKey, raw)
+		return nil, raw, err
+	}
+	return pack, raw, nil
+}
+
+//任务处理完成，从processing list删除
+func (this *RedisTaskQueue) Ack(processingKey string, raw []byte) error {
+	return this.pool.Cmd("lrem", processingKey, 1, raw).Err
+}
+
+//把processing list中未完成的任务放回队列，返回放回的数量
+func (this *RedisTaskQueue) Recover(processingKey string, queueKey string) (int, error) {
+	n := 0
+	for {
+		resp := this.pool.Cmd("rpoplpush", processingKey, queueKey)
+		if resp.Err != nil {
+			return n, resp.Err
+		}
+		if resp.IsType(redis.Nil) {
+			return n, nil
+		}
+		n++
+	}
+}
+
+func (this *RedisTaskQueue) Len(queueKey string) (int, error) {
+	return this.pool.Cmd("llen", queueKey).Int()
+}
@@ -0,0 +1,294 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/kdar/factorlog"
+)
+
+//robots.txt中的一条Allow/Disallow规则
+type robotsRule struct {
+	pattern string
+	allow   bool
+}
+
+//针对一组user-agent的规则
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+//解析后的robots.txt
+type Robots struct {
+	groups []*robotsGroup
+}
+
+//允许抓取全部页面的robots，robots.txt不存在时使用
+var AllowAllRobots = &Robots{}
+
+//禁止抓取全部页面的robots，robots.txt暂时无法获取时使用
+var DisallowAllRobots = &Robots{groups: []*robotsGroup{&robotsGroup{agents: []string{"*"}, rules: []robotsRule{robotsRule{pattern: "/", allow: false}}}}}
+
+func ParseRobots(content []byte) *Robots {
+	robots := &Robots{}
+	var group *robotsGroup
+	//上一行是否为user-agent，连续的user-agent属于同一组
+	lastIsAgent := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pos := strings.Index(line, "#"); pos >= 0 {
+			line = line[:pos]
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]))
+		val := strings.TrimSpace(line[colon+1:])
+
+		switch key {
+		case "user-agent":
+			if !lastIsAgent || group == nil {
+				group = &robotsGroup{}
+				robots.groups = append(robots.groups, group)
+			}
+			group.agents = append(group.agents, strings.ToLower(val))
+			lastIsAgent = true
+			continue
+		case "allow", "disallow":
+			//空的Disallow表示不限制
+			if group != nil && val != "" {
+				group.rules = append(group.rules, robotsRule{pattern: val, allow: key == "allow"})
+			}
+		case "crawl-delay":
+			if group != nil {
+				if seconds, err := strconv.ParseFloat(val, 64); err == nil && seconds >= 0 {
+					group.crawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+		lastIsAgent = false
+	}
+	return robots
+}
+
+//找到适用于agent的规则组：优先最长的匹配项，其次是*
+func (this *Robots) findGroup(agent string) *robotsGroup {
+	agent = strings.ToLower(agent)
+	var matched, wildcard *robotsGroup
+	matchedLen := 0
+	for _, group := range this.groups {
+		for _, a := range group.agents {
+			if a == "*" {
+				if wildcard == nil {
+					wildcard = group
+				}
+			} else if a != "" && strings.Contains(agent, a) && len(a) > matchedLen {
+				matched = group
+				matchedLen = len(a)
+			}
+		}
+	}
+	if matched != nil {
+		return matched
+	}
+	return wildcard
+}
+
+//判断agent能否抓取urlpath，最长匹配的规则生效，长度相同时Allow优先
+func (this *Robots) Allowed(agent string, urlpath string) bool {
+	group := this.findGroup(agent)
+	if group == nil {
+		return true
+	}
+	if urlpath == "" {
+		urlpath = "/"
+	}
+	allowed := true
+	matchedLen := -1
+	for _, rule := range group.rules {
+		if !matchRobotsPattern(rule.pattern, urlpath) {
+			continue
+		}
+		if len(rule.pattern) > matchedLen || (len(rule.pattern) == matchedLen && rule.allow) {
+			allowed = rule.allow
+			matchedLen = len(rule.pattern)
+		}
+	}
+	return allowed
+}
+
+//robots.txt中为agent指定的Crawl-delay，没有则返回0
+func (this *Robots) CrawlDelay(agent string) time.Duration {
+	group := this.findGroup(agent)
+	if group == nil {
+		return 0
+	}
+	return group.crawlDelay
+}
+
+//支持 * 通配任意字符，$ 匹配结尾
+func matchRobotsPattern(pattern string, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if i == len(parts)-1 && anchored {
+			return strings.HasSuffix(path[pos:], parts[i])
+		}
+		idx := strings.Index(path[pos:], parts[i])
+		if idx < 0 {
+			return false
+		}
+		pos += idx + len(parts[i])
+	}
+	if anchored {
+		return pos == len(path)
+	}
+	return true
+}
+
+//robots.txt暂时无法获取（网络错误或5xx），调用方应稍后重试，而不是视为禁止抓取
+var ErrRobotsUnavailable = errors.New("robots.txt unavailable")
+
+type robotsEntry struct {
+	robots      *Robots
+	expireAt    time.Time
+	unavailable bool
+}
+
+//后台同时获取robots.txt的最大站点数
+const robotsFetchSlots = 8
+
+//按站点缓存robots.txt，过期后重新获取
+type RobotsCache struct {
+	agent      string
+	ttl        time.Duration
+	httpClient *HttpClient
+	entries    map[string]*robotsEntry
+	fetching   map[string]bool //正在后台获取的站点
+	fetchSlots chan bool
+	lock       sync.Mutex
+}
+
+func InitRobotsCache(httpClient *HttpClient, agent string, ttl time.Duration) *RobotsCache {
+	if agent == "" {
+		agent = "*"
+	}
+	return &RobotsCache{
+		agent:      agent,
+		ttl:        ttl,
+		httpClient: httpClient,
+		entries:    map[string]*robotsEntry{},
+		fetching:   map[string]bool{},
+		fetchSlots: make(chan bool, robotsFetchSlots)}
+}
+
+//domain含协议部分，例如 http://www.example.com；robots.txt无法获取时返回DisallowAllRobots
+func (this *RobotsCache) Get(domain string) *Robots {
+	return this.get(domain).robots
+}
+
+func (this *RobotsCache) get(domain string) *robotsEntry {
+	domain = strings.TrimSuffix(domain, "/")
+	this.lock.Lock()
+	entry, ok := this.entries[domain]
+	this.lock.Unlock()
+	if ok && time.Now().Before(entry.expireAt) {
+		return entry
+	}
+
+	entry = this.fetch(domain)
+	this.lock.Lock()
+	this.entries[domain] = entry
+	this.lock.Unlock()
+	return entry
+}
+
+func (this *RobotsCache) Allowed(domain string, urlpath string) bool {
+	return this.Get(domain).Allowed(this.agent, urlpath)
+}
+
+//同Allowed，但robots.txt暂时无法获取时返回ErrRobotsUnavailable
+func (this *RobotsCache) Check(domain string, urlpath string) (bool, error) {
+	entry := this.get(domain)
+	if entry.unavailable {
+		return false, ErrRobotsUnavailable
+	}
+	return entry.robots.Allowed(this.agent, urlpath), nil
+}
+
+func (this *RobotsCache) CrawlDelay(domain string) time.Duration {
+	return this.Get(domain).CrawlDelay(this.agent)
+}
+
+//同CrawlDelay，但不等待网络：没有缓存或已过期时在后台获取，先使用缓存中（可能已过期）的值，没有缓存时返回0
+func (this *RobotsCache) CachedCrawlDelay(domain string) time.Duration {
+	domain = strings.TrimSuffix(domain, "/")
+	this.lock.Lock()
+	entry, ok := this.entries[domain]
+	this.lock.Unlock()
+	if !ok || !time.Now().Before(entry.expireAt) {
+		this.refresh(domain)
+	}
+	if !ok {
+		return 0
+	}
+	return entry.robots.CrawlDelay(this.agent)
+}
+
+//在后台获取robots.txt，同一站点同时只获取一次
+func (this *RobotsCache) refresh(domain string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.fetching[domain] {
+		return
+	}
+	this.fetching[domain] = true
+	go func() {
+		this.fetchSlots <- true
+		entry := this.fetch(domain)
+		<-this.fetchSlots
+		this.lock.Lock()
+		this.entries[domain] = entry
+		delete(this.fetching, domain)
+		this.lock.Unlock()
+	}()
+}
+
+//4xx视为没有限制；5xx或网络错误标记为暂时无法获取（按全部禁止处理），且只缓存较短时间以便尽快重试
+func (this *RobotsCache) fetch(domain string) *robotsEntry {
+	robotsUrl := domain + "/robots.txt"
+	status, body, err := this.httpClient.GetStatus(robotsUrl)
+	retryTtl := this.ttl
+	if retryTtl > 10*time.Minute {
+		retryTtl = 10 * time.Minute
+	}
+	unavailable := &robotsEntry{robots: DisallowAllRobots, expireAt: time.Now().Add(retryTtl), unavailable: true}
+	switch {
+	case err != nil:
+		log.Warnln("get ", robotsUrl, " error: ", err)
+		return unavailable
+	case status >= 500:
+		log.Warnln("get ", robotsUrl, " status: ", status)
+		return unavailable
+	case status >= 400:
+		return &robotsEntry{robots: AllowAllRobots, expireAt: time.Now().Add(this.ttl)}
+	}
+	return &robotsEntry{robots: ParseRobots(body), expireAt: time.Now().Add(this.ttl)}
+}
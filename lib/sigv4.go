@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//AWS Signature Version 4的时间格式
+const (
+	amzDateFormat  = "20060102T150405Z"
+	amzShortFormat = "20060102"
+)
+
+//空body的sha256
+const EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+//SigV4签名用的凭证
+type AwsCredential struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+	Service   string
+}
+
+func PayloadHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//用SigV4给请求签名：设置x-amz-date, x-amz-content-sha256和Authorization头；
+//签名覆盖host和签名时请求上已有的所有头，之后再加的头（如User-Agent）不参与签名
+func SignV4(req *http.Request, payloadHash string, cred AwsCredential, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Del("Authorization")
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for key, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, val := range values {
+			trimmed[i] = strings.Join(strings.Fields(val), " ")
+		}
+		headers[strings.ToLower(key)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		AwsEscapePath(req.URL.Path),
+		awsCanonicalQuery(req),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash}, "\n")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", now.Format(amzShortFormat), cred.Region, cred.Service)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, PayloadHash([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+cred.SecretKey), now.Format(amzShortFormat))
+	signingKey = hmacSha256(signingKey, cred.Region)
+	signingKey = hmacSha256(signingKey, cred.Service)
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cred.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//按AWS的规则编码：除字母数字和-._~外都编码，空格编码为%20
+func AwsEscape(s string) string {
+	buf := strings.Builder{}
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '.' || b == '_' || b == '~' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+//编码路径，保留/
+func AwsEscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = AwsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func awsCanonicalQuery(req *http.Request) string {
+	query := map[string][]string{}
+	keys := []string{}
+	for key, values := range req.URL.Query() {
+		escaped := AwsEscape(key)
+		keys = append(keys, escaped)
+		for _, val := range values {
+			query[escaped] = append(query[escaped], AwsEscape(val))
+		}
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, val := range values {
+			pairs = append(pairs, key+"="+val)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
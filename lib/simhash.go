@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+)
+
+//simhash特征使用的字符n-gram长度，按字符切分可同时适用于中日文和西文
+const simhashShingle = 3
+
+//页面内容的精确hash
+func ContentHash(page []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(page))
+}
+
+//计算页面可见文本的64位SimHash，用于判断内容是否近似
+func SimHash(page []byte) uint64 {
+	features := map[string]int{}
+	runes := []rune(normalizeText(strings.Join(PageTexts(page), " ")))
+	if len(runes) == 0 {
+		return 0
+	}
+	if len(runes) < simhashShingle {
+		features[string(runes)]++
+	} else {
+		for i := 0; i+simhashShingle <= len(runes); i++ {
+			features[string(runes[i:i+simhashShingle])]++
+		}
+	}
+
+	var weights [64]int
+	for feature, weight := range features {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		for i := 0; i < 64; i++ {
+			if sum&(1<<uint(i)) != 0 {
+				weights[i] += weight
+			} else {
+				weights[i] -= weight
+			}
+		}
+	}
+
+	var fingerprint uint64 = 0
+	for i := 0; i < 64; i++ {
+		if weights[i] > 0 {
+			fingerprint |= 1 << uint(i)
+		}
+	}
+	return fingerprint
+}
+
+//两个SimHash的海明距离
+func SimHashDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+//SimHash按16位切成的段数，海明距离小于该值的两个SimHash至少有一段完全相同
+const SimHashBands = 4
+
+//把SimHash切成SimHashBands段，用于按段索引查找近似的候选
+func SimHashBandsOf(hash uint64) [SimHashBands]uint16 {
+	var bands [SimHashBands]uint16
+	for i := 0; i < SimHashBands; i++ {
+		bands[i] = uint16(hash >> uint(16*i))
+	}
+	return bands
+}
+
+//转小写并合并空白
+func normalizeText(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), unicode.IsSpace), " ")
+}
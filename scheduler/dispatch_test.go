@@ -0,0 +1,56 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//按hostname+domain禁止访问的礼貌检查
+type stubPolite struct {
+	denied map[string]bool
+}
+
+func (this *stubPolite) IsPolite(domain string, hostname string, ignoreRobots bool) bool {
+	return !this.denied[hostname+" "+domain]
+}
+
+func (this *stubPolite) SetLastVisitTime(domain string, hostname string, ts int64) error {
+	return nil
+}
+
+func packIds(batch []types.TaskPack) []int32 {
+	ids := []int32{}
+	for _, pack := range batch {
+		ids = append(ids, pack.TaskId)
+	}
+	return ids
+}
+
+//任务按顺序分给空闲位置最多的目标；同一domain每个目标每批只分一个，不礼貌的目标跳过，不超过空闲位置数
+func TestPlanDispatch(t *testing.T) {
+	polite := &stubPolite{denied: map[string]bool{"b:9191 http://c.com": true}}
+	scheduler := &Scheduler{politeVisitor: polite}
+	tasks := []types.CrawlTask{
+		{Id: 1, Domain: "http://a.com"},
+		{Id: 2, Domain: "http://a.com"},
+		{Id: 3, Domain: "http://a.com"},
+		{Id: 4, Domain: "http://b.com"},
+		{Id: 5, Domain: "http://c.com"},
+		{Id: 6, Domain: "http://d.com"},
+		{Id: 7, Domain: "http://e.com"}}
+	targets := []types.FetcherInfo{{Addr: "a:9191"}, {Addr: "b:9191"}, {Addr: "c:9191"}}
+
+	batches := scheduler.planDispatch(tasks, targets, []int{1, 3, 0})
+	got := [][]int32{packIds(batches[0]), packIds(batches[1]), packIds(batches[2])}
+	//1给空闲最多的b，2的domain在b已分过，给a；3没有目标；4给b；5在b不礼貌，a已满；6给b后b也满
+	expected := [][]int32{{2}, {1, 4, 6}, {}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Error("unexpected batches: ", got)
+	}
+
+	if batches = scheduler.planDispatch(tasks, targets, []int{0, 0, 0}); len(batches[0])+len(batches[1])+len(batches[2]) != 0 {
+		t.Error("expect nothing dispatched without free slots, got ", batches)
+	}
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/kdar/factorlog"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//已注册的fetcher，心跳超过timeout未更新即认为不可用，不再分发任务；
+//不可用的fetcher恢复心跳后重新可用，退出时主动注销
+type FetcherRegistry struct {
+	lock     sync.Mutex
+	fetchers map[string]*types.FetcherInfo
+	timeout  time.Duration
+	used     bool //是否有fetcher注册过，全部注销后仍为true
+}
+
+func InitFetcherRegistry(timeout time.Duration) *FetcherRegistry {
+	return &FetcherRegistry{fetchers: map[string]*types.FetcherInfo{}, timeout: timeout}
+}
+
+//注册或心跳，更新fetcher信息；返回fetcher之前是否未注册
+func (this *FetcherRegistry) Touch(info types.FetcherInfo, now time.Time) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	old, ok := this.fetchers[info.Addr]
+	if ok {
+		info.RegisterTime = old.RegisterTime
+		if !this.alive(old, now) {
+			log.Warnln("fetcher ", info.Addr, " is back.")
+		}
+	} else {
+		info.RegisterTime = now.Unix()
+	}
+	info.LastHeartbeat = now.Unix()
+	info.Live = true
+	this.fetchers[info.Addr] = &info
+	this.used = true
+	return !ok
+}
+
+//记录推送给fetcher的任务数，在下次心跳前从空闲位置中扣除
+func (this *FetcherRegistry) Reserve(addr string, n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if info, ok := this.fetchers[addr]; ok {
+		info.FreeSlots -= n
+		if info.FreeSlots < 0 {
+			info.FreeSlots = 0
+		}
+	}
+}
+
+func (this *FetcherRegistry) Unregister(addr string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, ok := this.fetchers[addr]
+	delete(this.fetchers, addr)
+	return ok
+}
+
+//当前是否没有注册的fetcher（心跳已超时的也算注册）
+func (this *FetcherRegistry) Empty() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.fetchers) == 0
+}
+
+//启动以来是否有fetcher注册过，包括已经注销的
+func (this *FetcherRegistry) Used() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.used
+}
+
+//心跳未超时的fetcher，按地址排序
+func (this *FetcherRegistry) Live(now time.Time) []types.FetcherInfo {
+	live := []types.FetcherInfo{}
+	for _, info := range this.All(now) {
+		if info.Live {
+			live = append(live, info)
+		}
+	}
+	return live
+}
+
+//所有注册的fetcher，按地址排序；心跳刚超时的fetcher会记录日志
+func (this *FetcherRegistry) All(now time.Time) []types.FetcherInfo {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	fetchers := []types.FetcherInfo{}
+	for _, info := range this.fetchers {
+		if info.Live && !this.alive(info, now) {
+			log.Warnln("heartbeat of fetcher ", info.Addr, " lapsed, last heartbeat: ", time.Unix(info.LastHeartbeat, 0))
+			info.Live = false
+		}
+		fetchers = append(fetchers, *info)
+	}
+	sort.Slice(fetchers, func(i, j int) bool { return fetchers[i].Addr < fetchers[j].Addr })
+	return fetchers
+}
+
+func (this *FetcherRegistry) alive(info *types.FetcherInfo, now time.Time) bool {
+	return now.Sub(time.Unix(info.LastHeartbeat, 0)) <= this.timeout
+}
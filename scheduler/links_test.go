@@ -0,0 +1,27 @@
+package scheduler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zhaozhi406/crawler/dao"
+)
+
+//超过任务表字段长度的链接在入库前过滤掉
+func TestSplitLinkLength(t *testing.T) {
+	domain, urlpath, err := splitLink("http://www.example.com/a?x=1")
+	if err != nil || domain != "http://www.example.com" || urlpath != "/a?x=1" {
+		t.Error("unexpected split: ", domain, urlpath, err)
+	}
+	longPath := "/" + strings.Repeat("a", dao.TaskUrlpathMaxLen)
+	if _, _, err = splitLink("http://www.example.com" + longPath); err == nil {
+		t.Error("expect error for long urlpath")
+	}
+	if _, _, err = splitLink("http://www.example.com" + longPath[:dao.TaskUrlpathMaxLen]); err != nil {
+		t.Error("urlpath of max length should be allowed: ", err)
+	}
+	longHost := strings.Repeat("a", dao.TaskDomainMaxLen) + ".com"
+	if _, _, err = splitLink("http://" + longHost + "/"); err == nil {
+		t.Error("expect error for long domain")
+	}
+}
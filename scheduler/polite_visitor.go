@@ -5,22 +5,55 @@ import (
 	log "github.com/kdar/factorlog"
 	"github.com/mediocregopher/radix.v2/pool"
 	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/zhaozhi406/crawler/lib"
+	"math"
 	"strings"
 	"time"
 )
 
+//礼貌访问控制：判断现在能否从hostname访问domain，分发后记录访问时间
+type PoliteChecker interface {
+	IsPolite(domain string, hostname string, ignoreRobots bool) bool
+	SetLastVisitTime(domain string, hostname string, ts int64) error
+}
+
+//在redis中记录各个host对domain的最后访问时间
 type PoliteVisitor struct {
 	pool                 *pool.Pool
-	minHostVisitInterval int64 //连续访问同一host的最小时间间隔
+	minHostVisitInterval int64            //连续访问同一host的最小时间间隔
+	domainIntervals      map[string]int64 //按domain单独指定的访问间隔，robots.txt没有Crawl-delay时使用
+	robotsCache          *lib.RobotsCache
 }
 
-func InitPoliteVisitor(pool *pool.Pool, minVisitInterval int64) *PoliteVisitor {
-	return &PoliteVisitor{pool: pool, minHostVisitInterval: minVisitInterval}
+func InitPoliteVisitor(pool *pool.Pool, minVisitInterval int64, domainIntervals map[string]int64, robotsCache *lib.RobotsCache) *PoliteVisitor {
+	intervals := map[string]int64{}
+	visitor := &PoliteVisitor{pool: pool, minHostVisitInterval: minVisitInterval, domainIntervals: intervals, robotsCache: robotsCache}
+	for domain, interval := range domainIntervals {
+		intervals[visitor.canonicalDomain(domain)] = interval
+	}
+	return visitor
 }
 
 //a convenient wrapper
-func (this *PoliteVisitor) IsPolite(domain string, hostname string) bool {
-	return time.Now().Unix()-this.GetLastVisitTime(domain, hostname) >= this.minHostVisitInterval
+func (this *PoliteVisitor) IsPolite(domain string, hostname string, ignoreRobots bool) bool {
+	return time.Now().Unix()-this.GetLastVisitTime(domain, hostname) >= this.VisitInterval(domain, ignoreRobots)
+}
+
+//访问domain的最小时间间隔：优先使用robots.txt中的Crawl-delay，其次是单独指定的间隔；
+//全局的minHostVisitInterval作为下限。robots.txt在后台获取，不阻塞分发，首次访问时还没有也不影响（没有访问记录）
+func (this *PoliteVisitor) VisitInterval(domain string, ignoreRobots bool) int64 {
+	var interval int64 = 0
+	if !ignoreRobots && this.robotsCache != nil {
+		delay := this.robotsCache.CachedCrawlDelay(domain)
+		interval = int64(math.Ceil(delay.Seconds()))
+	}
+	if interval == 0 {
+		interval = this.domainIntervals[this.canonicalDomain(domain)]
+	}
+	if interval < this.minHostVisitInterval {
+		interval = this.minHostVisitInterval
+	}
+	return interval
 }
 
 //hget hostname domain
@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"github.com/zhaozhi406/crawler/types"
+	"net/http"
+)
+
+//失败任务的重试策略：第n次重试前等待 baseDelay*2^n 秒，不超过maxDelay
+type RetryPolicy struct {
+	maxRetries int32
+	baseDelay  int64
+	maxDelay   int64
+}
+
+func InitRetryPolicy(maxRetries int32, baseDelay int64, maxDelay int64) *RetryPolicy {
+	if baseDelay <= 0 {
+		baseDelay = 1
+	}
+	if maxDelay < baseDelay {
+		maxDelay = baseDelay
+	}
+	return &RetryPolicy{maxRetries: maxRetries, baseDelay: baseDelay, maxDelay: maxDelay}
+}
+
+//根据错误分类判断失败是否值得重试：除超时和限流外的4xx不会因重试而改变
+func (this *RetryPolicy) ShouldRetry(errorClass string, statusCode int) bool {
+	switch errorClass {
+	case types.ERR_CLASS_ROBOTS_DENIED, types.ERR_CLASS_TOO_LARGE:
+		return false
+	case types.ERR_CLASS_4XX:
+		return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+//已重试retryTimes次后，是否还能重试
+func (this *RetryPolicy) CanRetry(retryTimes int32) bool {
+	return retryTimes < this.maxRetries
+}
+
+//已重试retryTimes次后，下次重试前的等待时间（秒）
+func (this *RetryPolicy) NextDelay(retryTimes int32) int64 {
+	delay := this.baseDelay
+	for i := int32(0); i < retryTimes; i++ {
+		delay *= 2
+		if delay >= this.maxDelay {
+			return this.maxDelay
+		}
+	}
+	return delay
+}
@@ -1,7 +1,9 @@
 package scheduler
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -11,28 +13,56 @@ import (
 	"github.com/zhaozhi406/crawler/lib"
 	"github.com/zhaozhi406/crawler/types"
 	"github.com/zhaozhi406/crawler/utils"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 type Scheduler struct {
 	fetchRulesPeriod time.Duration
 	fetchTasksPeriod time.Duration
+	reapLeasesPeriod time.Duration
+	taskLease        time.Duration //任务分发后的租约时长
+	retryPolicy      *RetryPolicy
+	simhashThreshold int //SimHash距离不超过该值即认为内容近似
 	listenAddr       string
+	linkDomains      []string //除父任务的站点外，允许跟随链接的站点（host），子域名也允许
 	db               *sqlx.DB
 	taskDao          *dao.TaskDao
-	fetchers         []string
+	historyDao       *dao.HistoryDao
+	fetchers         []string //静态配置的fetcher，没有fetcher注册时使用
+	registry         *FetcherRegistry
 	fetcherApi       map[string]string
-	politeVisitor    *PoliteVisitor
+	fetcherClient    *lib.HttpClient //推送任务和查询fetcher状态
+	politeVisitor    PoliteChecker
 	redisPool        *pool.Pool
 	redisPoolSize    int
 	redisHeartbeat   int
+	dispatchMode     string //push: 定期推送给fetcher，pull: fetcher有空闲时拉取，redis: 定期放入redis任务队列
+	taskQueue        *lib.RedisTaskQueue
+	sharedQueue      bool       //redis模式下所有fetcher共用一个队列
+	queueMaxLen      int        //redis模式下每个队列最多积压的任务数
+	dispatchLock     sync.Mutex //挑选和租出任务时加锁，避免同一任务被重复挑选
 	quitChan         chan bool
 }
 
+const (
+	DISPATCH_PUSH  = "push"
+	DISPATCH_PULL  = "pull"
+	DISPATCH_REDIS = "redis"
+)
+
+//一次最多拉取的任务数
+const maxPullTasks = 500
+
 const ErrOk = 0
 
 const (
@@ -46,14 +76,55 @@ const (
 
 func InitScheduler(db *sqlx.DB, config map[string]string) *Scheduler {
 	taskDao := dao.InitTaskDao(db)
+	historyDao := dao.InitHistoryDao(db)
+	if ok, err := historyDao.HasReportIndex(); err == nil && !ok {
+		log.Errorln("missing unique index on ", dao.HistoryTable, ".report_id, redelivered reports will be counted twice. see conf/upgrade/023_report_id.sql")
+	}
 	seconds, _ := strconv.Atoi(config["fetch_rules_period"])
 	fetchRulesPeriod := time.Duration(seconds) * time.Second
 	seconds, _ = strconv.Atoi(config["fetch_tasks_period"])
 	fetchTasksPeriod := time.Duration(seconds) * time.Second
+	seconds, err := strconv.Atoi(config["reap_leases_period"])
+	if err != nil {
+		seconds = 60
+	}
+	reapLeasesPeriod := time.Duration(seconds) * time.Second
+	seconds, err = strconv.Atoi(config["task_lease"])
+	if err != nil {
+		seconds = 300
+	}
+	taskLease := time.Duration(seconds) * time.Second
+	maxRetries, err := strconv.Atoi(config["max_retries"])
+	if err != nil {
+		maxRetries = 3
+	}
+	retryBaseDelay, _ := strconv.Atoi(config["retry_base_delay"])
+	retryMaxDelay, _ := strconv.Atoi(config["retry_max_delay"])
+	retryPolicy := InitRetryPolicy(int32(maxRetries), int64(retryBaseDelay), int64(retryMaxDelay))
+	simhashThreshold, err := strconv.Atoi(config["simhash_threshold"])
+	if err != nil {
+		simhashThreshold = 3
+	}
+	if simhashThreshold >= lib.SimHashBands {
+		log.Warnln("simhash_threshold ", simhashThreshold, " is larger than ", lib.SimHashBands-1, ", some near duplicates will be missed")
+	}
+	linkDomains := []string{}
+	json.Unmarshal([]byte(config["link_domains"]), &linkDomains)
 	listenAddr := config["listen_addr"]
-	fetchers := strings.Split(strings.Replace(config["fetchers"], " ", "", -1), ",")
+	fetchers := []string{}
+	for _, fetcher := range strings.Split(strings.Replace(config["fetchers"], " ", "", -1), ",") {
+		if fetcher != "" {
+			fetchers = append(fetchers, fetcher)
+		}
+	}
+	seconds, err = strconv.Atoi(config["fetcher_heartbeat_timeout"])
+	if err != nil || seconds <= 0 {
+		seconds = 30
+	}
+	registry := InitFetcherRegistry(time.Duration(seconds) * time.Second)
 	fetcherApi := map[string]string{}
 	json.Unmarshal([]byte(config["fetcher_api"]), &fetcherApi)
+	fetcherClient := lib.InitHttpClient(map[string]string{"total_timeout": config["fetcher_timeout"]})
 	minHostVisitInterval, _ := strconv.Atoi(config["min_host_visit_interval"])
 	redisAddr := config["redis_addr"]
 	redisPoolSize, _ := strconv.Atoi(config["redis_pool_size"])
@@ -64,22 +135,56 @@ func InitScheduler(db *sqlx.DB, config map[string]string) *Scheduler {
 		log.Errorln("init redis pool error: ", err)
 		return nil
 	}
-	politeVisitor := InitPoliteVisitor(pool, int64(minHostVisitInterval))
+	domainIntervals := map[string]int64{}
+	json.Unmarshal([]byte(config["domain_visit_intervals"]), &domainIntervals)
+	robotsTtl, err := strconv.Atoi(config["robots_ttl"])
+	if err != nil {
+		robotsTtl = 86400
+	}
+	robotsTimeout := config["robots_timeout"]
+	robotsClient := lib.InitHttpClient(map[string]string{
+		"connect_timeout": robotsTimeout,
+		"read_timeout":    robotsTimeout,
+		"total_timeout":   robotsTimeout,
+		"max_body_bytes":  "524288"})
+	robotsCache := lib.InitRobotsCache(robotsClient, config["robots_user_agent"], time.Duration(robotsTtl)*time.Second)
+	politeVisitor := InitPoliteVisitor(pool, int64(minHostVisitInterval), domainIntervals, robotsCache)
+
+	dispatchMode := config["dispatch_mode"]
+	if dispatchMode != DISPATCH_PULL && dispatchMode != DISPATCH_REDIS {
+		dispatchMode = DISPATCH_PUSH
+	}
+	queueMaxLen, err := strconv.Atoi(config["task_queue_max_len"])
+	if err != nil || queueMaxLen <= 0 {
+		queueMaxLen = 100
+	}
 
 	quitChan := make(chan bool, 1)
 
 	return &Scheduler{
 		fetchRulesPeriod: fetchRulesPeriod,
 		fetchTasksPeriod: fetchTasksPeriod,
+		reapLeasesPeriod: reapLeasesPeriod,
+		taskLease:        taskLease,
+		retryPolicy:      retryPolicy,
+		simhashThreshold: simhashThreshold,
 		listenAddr:       listenAddr,
+		linkDomains:      linkDomains,
 		db:               db,
 		taskDao:          taskDao,
+		historyDao:       historyDao,
 		fetchers:         fetchers,
+		registry:         registry,
 		fetcherApi:       fetcherApi,
+		fetcherClient:    fetcherClient,
 		politeVisitor:    politeVisitor,
 		redisPool:        pool,
 		redisPoolSize:    redisPoolSize,
 		redisHeartbeat:   redisHeartbeat,
+		dispatchMode:     dispatchMode,
+		taskQueue:        lib.InitRedisTaskQueue(pool, config["task_queue_prefix"]),
+		sharedQueue:      config["task_queue_shared"] == "true",
+		queueMaxLen:      queueMaxLen,
 		quitChan:         quitChan}
 }
 
@@ -93,12 +198,21 @@ func (this *Scheduler) Run() {
 	cronJob := lib.InitCronJob(f, nil, this.fetchRulesPeriod)
 	go cronJob.Run()
 
-	//a cronjob wrapper for DispatchTasks
-	f1 := func(dummy ...interface{}) {
-		this.DispatchTasks()
+	//a cronjob wrapper for DispatchTasks，pull模式下由fetcher拉取任务
+	if this.dispatchMode != DISPATCH_PULL {
+		f1 := func(dummy ...interface{}) {
+			this.DispatchTasks()
+		}
+		cronJob1 := lib.InitCronJob(f1, nil, this.fetchTasksPeriod)
+		go cronJob1.Run()
 	}
-	cronJob1 := lib.InitCronJob(f1, nil, this.fetchTasksPeriod)
-	go cronJob1.Run()
+
+	//a cronjob wrapper for ReapExpiredLeases
+	f2 := func(dummy ...interface{}) {
+		this.ReapExpiredLeases()
+	}
+	cronJob2 := lib.InitCronJob(f2, nil, this.reapLeasesPeriod)
+	go cronJob2.Run()
 
 	go this.redisPool.KeepAlive(this.redisHeartbeat)
 
@@ -111,6 +225,13 @@ func (this *Scheduler) Run() {
 
 //分发task给Fetcher
 func (this *Scheduler) DispatchTasks() {
+	//查询空闲位置需要请求各个fetcher，在加锁前并发进行
+	targets := this.dispatchTargets()
+	free := this.targetsFreeSlots(targets)
+
+	this.dispatchLock.Lock()
+	defer this.dispatchLock.Unlock()
+
 	//获取等待任务
 	tasks, err := this.FetchTasks()
 	if err != nil {
@@ -124,41 +245,323 @@ func (this *Scheduler) DispatchTasks() {
 	//排序
 	sorter := lib.CrawlTaskSorter{Now: time.Now().Unix()}
 	sorter.Sort(tasks, nil)
-	//post到fetchers
-	picked := map[int32]bool{}
-	httpClient := lib.HttpClient{}
-	for _, fetcher := range this.fetchers {
-		taskPacks := []types.TaskPack{}
-		//挑选未分配的，且符合礼貌原则的任务
-		for _, task := range tasks {
-			_, ok := picked[task.Id]
-			if !ok && this.politeVisitor.IsPolite(task.Domain, fetcher) {
-				taskPacks = append(taskPacks, types.TaskPack{TaskId: task.Id, Domain: task.Domain, Urlpath: task.Urlpath})
-				picked[task.Id] = true
-				//缓存最后访问时间，实际有误差，但是实现简单
-				this.politeVisitor.SetLastVisitTime(task.Domain, fetcher, time.Now().Unix())
+	for i := range free {
+		if free[i] > len(tasks) {
+			free[i] = len(tasks)
+		}
+	}
+	batches := this.planDispatch(tasks, targets, free)
+	for i, target := range targets {
+		fetcher := target.Addr
+		//先标记为抓取中再分发，避免fetcher的报告先于标记到达
+		taskPacks := this.leaseTasks(batches[i], fetcher)
+		if len(taskPacks) == 0 {
+			continue
+		}
+		log.Debugln("dispatch ", len(taskPacks), " tasks to ", fetcher, ", free slots: ", free[i])
+		var accepted map[int32]bool
+		if this.dispatchMode == DISPATCH_REDIS {
+			accepted = this.enqueueTasks(targetQueue(target), taskPacks)
+		} else {
+			accepted = this.pushTasks(fetcher, taskPacks)
+			this.registry.Reserve(fetcher, len(accepted))
+		}
+		//fetcher未接收的任务放回等待队列
+		rejected := []int32{}
+		for _, pack := range taskPacks {
+			if !accepted[pack.TaskId] {
+				rejected = append(rejected, pack.TaskId)
 			}
 		}
-		jsonBytes, err := json.Marshal(taskPacks)
+		if len(rejected) > 0 {
+			n, _ := this.taskDao.ReleaseTasks(rejected)
+			log.Warnln("fetcher ", fetcher, " did not accept ", len(rejected), " tasks, released: ", n)
+		}
+	}
+}
+
+//分发的目标：有fetcher注册过后只分发给心跳未超时的，全部注销或超时时没有目标，不再回到配置的fetchers；
+//没有fetcher注册过时使用配置的fetchers，redis共享队列模式下只有一个目标
+func (this *Scheduler) dispatchTargets() []types.FetcherInfo {
+	if this.dispatchMode == DISPATCH_REDIS && this.sharedQueue {
+		return []types.FetcherInfo{{Addr: lib.SharedTaskQueue}}
+	}
+	if this.registry.Used() {
+		return this.registry.Live(time.Now())
+	}
+	targets := []types.FetcherInfo{}
+	for _, fetcher := range this.fetchers {
+		targets = append(targets, types.FetcherInfo{Addr: fetcher})
+	}
+	return targets
+}
+
+func targetQueue(target types.FetcherInfo) string {
+	if target.TaskQueue != "" {
+		return target.TaskQueue
+	}
+	return target.Addr
+}
+
+//并发查询各个目标的空闲位置数
+func (this *Scheduler) targetsFreeSlots(targets []types.FetcherInfo) []int {
+	free := make([]int, len(targets))
+	wg := sync.WaitGroup{}
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			free[i] = this.freeSlots(targets[i], math.MaxInt32)
+		}(i)
+	}
+	wg.Wait()
+	return free
+}
+
+//目标的空闲位置数。redis模式下队列中积压的任务不超过queueMaxLen，避免积压过久租约到期；
+//push模式下优先查询fetcher的/status，失败时使用心跳上报的数据，都没有时最多为max
+func (this *Scheduler) freeSlots(target types.FetcherInfo, max int) int {
+	free := max
+	if this.dispatchMode == DISPATCH_REDIS {
+		queue := targetQueue(target)
+		queueLen, err := this.taskQueue.Len(this.taskQueue.QueueKey(queue))
 		if err != nil {
-			log.Errorln("make task packs error: ", err)
-		} else {
-			param := url.Values{}
-			param.Add("tasks", string(jsonBytes))
-			result, err := httpClient.Post("http://"+fetcher+this.fetcherApi["push_tasks"], param)
-			if err != nil {
-				log.Errorln("post task packs to fetcher:", fetcher, ", error:", err, " data:", string(jsonBytes))
-			} else {
-				jsonResult := types.JsonResult{}
-				err = json.Unmarshal(result, &jsonResult)
-				if err != nil {
-					log.Errorln("json unmarshal error:", err, " data:", string(result))
-				} else {
-					log.Infoln("get push tasks response: ", jsonResult)
-				}
+			log.Errorln("get length of task queue ", queue, " error: ", err)
+			return 0
+		}
+		free = this.queueMaxLen - queueLen
+	} else if status, err := this.fetcherStatus(target.Addr); err == nil {
+		free = status.FreeSlots
+	} else if target.LastHeartbeat > 0 {
+		log.Warnln("get status of fetcher ", target.Addr, " error: ", err, ", use heartbeat data.")
+		free = target.FreeSlots
+	}
+	if free > max {
+		free = max
+	}
+	if free < 0 {
+		free = 0
+	}
+	return free
+}
+
+//查询fetcher的状态，fetcher_api中没有status时返回错误
+func (this *Scheduler) fetcherStatus(fetcher string) (types.FetcherInfo, error) {
+	info := types.FetcherInfo{}
+	api := this.fetcherApi["status"]
+	if api == "" {
+		return info, errors.New("no status api")
+	}
+	res, err := this.fetcherClient.Get("http://" + fetcher + api)
+	if err != nil {
+		return info, err
+	}
+	result := types.JsonResult{Data: &info}
+	err = json.Unmarshal(res, &result)
+	if err == nil && result.Err != ErrOk {
+		err = fmt.Errorf("error response: %s", string(res))
+	}
+	return info, err
+}
+
+//按优先级把任务分配给各个目标，每个任务分给空闲位置最多且符合礼貌原则的目标，使负载分散；
+//每个目标最多分配free[i]个任务，同一domain每批只分配一个
+func (this *Scheduler) planDispatch(tasks []types.CrawlTask, targets []types.FetcherInfo, free []int) [][]types.TaskPack {
+	batches := make([][]types.TaskPack, len(targets))
+	domains := make([]map[string]bool, len(targets))
+	remaining := make([]int, len(targets))
+	total := 0
+	for i := range targets {
+		domains[i] = map[string]bool{}
+		remaining[i] = free[i]
+		total += free[i]
+	}
+	order := make([]int, len(targets))
+	for _, task := range tasks {
+		if total <= 0 {
+			break
+		}
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool { return remaining[order[a]] > remaining[order[b]] })
+		for _, i := range order {
+			if remaining[i] <= 0 {
+				break
 			}
+			if domains[i][task.Domain] || !this.politeVisitor.IsPolite(task.Domain, targets[i].Addr, task.IgnoreRobots) {
+				continue
+			}
+			batches[i] = append(batches[i], makeTaskPack(task))
+			domains[i][task.Domain] = true
+			remaining[i]--
+			total--
+			break
 		}
 	}
+	return batches
+}
+
+//post到fetcher的/push/tasks，返回fetcher接收的任务
+func (this *Scheduler) pushTasks(fetcher string, taskPacks []types.TaskPack) map[int32]bool {
+	accepted := map[int32]bool{}
+	jsonBytes, err := json.Marshal(taskPacks)
+	if err != nil {
+		log.Errorln("make task packs error: ", err)
+		return accepted
+	}
+	param := url.Values{}
+	param.Add("tasks", string(jsonBytes))
+	result, err := this.fetcherClient.Post("http://"+fetcher+this.fetcherApi["push_tasks"], param)
+	if err != nil {
+		log.Errorln("post task packs to fetcher:", fetcher, ", error:", err, " data:", string(jsonBytes))
+		return accepted
+	}
+	jsonResult := struct {
+		types.JsonResult
+		Data []types.TaskPack `json:"data,omitempty"`
+	}{}
+	err = json.Unmarshal(result, &jsonResult)
+	if err != nil {
+		log.Errorln("json unmarshal error:", err, " data:", string(result))
+		return accepted
+	}
+	log.Infoln("get push tasks response: ", jsonResult)
+	for _, pack := range jsonResult.Data {
+		accepted[pack.TaskId] = true
+	}
+	return accepted
+}
+
+//放入redis任务队列，成功则全部接收
+func (this *Scheduler) enqueueTasks(queue string, taskPacks []types.TaskPack) map[int32]bool {
+	accepted := map[int32]bool{}
+	err := this.taskQueue.Push(this.taskQueue.QueueKey(queue), taskPacks)
+	if err != nil {
+		log.Errorln("push tasks to redis queue ", queue, " error: ", err)
+		return accepted
+	}
+	log.Infoln("push ", len(taskPacks), " tasks to redis queue ", queue)
+	for _, pack := range taskPacks {
+		accepted[pack.TaskId] = true
+	}
+	return accepted
+}
+
+//为fetcher挑选未分配的，且符合礼貌原则的任务，最多max个；同一domain每批只挑一个
+func (this *Scheduler) pickTasks(tasks []types.CrawlTask, picked map[int32]bool, fetcher string, max int) []types.TaskPack {
+	taskPacks := []types.TaskPack{}
+	domains := map[string]bool{}
+	for _, task := range tasks {
+		if len(taskPacks) >= max {
+			break
+		}
+		if picked[task.Id] || domains[task.Domain] || !this.politeVisitor.IsPolite(task.Domain, fetcher, task.IgnoreRobots) {
+			continue
+		}
+		taskPacks = append(taskPacks, makeTaskPack(task))
+		picked[task.Id] = true
+		domains[task.Domain] = true
+	}
+	return taskPacks
+}
+
+//租出任务并记录访问时间，返回实际租出的任务
+func (this *Scheduler) leaseTasks(taskPacks []types.TaskPack, fetcher string) []types.TaskPack {
+	if len(taskPacks) == 0 {
+		return taskPacks
+	}
+	taskIds := []int32{}
+	for _, pack := range taskPacks {
+		taskIds = append(taskIds, pack.TaskId)
+	}
+	leasedIds, err := this.taskDao.LeaseTasks(taskIds, time.Now().Add(this.taskLease).Unix())
+	if err != nil {
+		log.Errorln("lease tasks error: ", err)
+	}
+	leased := map[int32]bool{}
+	for _, taskId := range leasedIds {
+		leased[taskId] = true
+	}
+	leasedPacks := []types.TaskPack{}
+	for _, pack := range taskPacks {
+		if leased[pack.TaskId] {
+			leasedPacks = append(leasedPacks, pack)
+			//缓存最后访问时间，实际有误差，但是实现简单
+			this.politeVisitor.SetLastVisitTime(pack.Domain, fetcher, time.Now().Unix())
+		}
+	}
+	return leasedPacks
+}
+
+func makeTaskPack(task types.CrawlTask) types.TaskPack {
+	pack := types.TaskPack{TaskId: task.Id, Domain: task.Domain, Urlpath: task.Urlpath, FollowLinks: task.FollowLinks, Xpath: task.Xpath, IgnoreRobots: task.IgnoreRobots}
+	pack.ContentHash = task.ContentHash
+	if task.Watch != types.WATCH_NONE {
+		pack.Watch = task.Watch
+		pack.Webhook = task.Webhook
+		pack.PageKey = task.PageKey
+		pack.DataKey = task.DataKey
+	}
+	if task.Cycle > 0 {
+		pack.Etag = task.Etag
+		pack.LastModified = task.LastModified
+	}
+	return pack
+}
+
+//fetcher有空闲时拉取任务，参数：max（最多拉取的任务数），fetcher（fetcher的地址，用于礼貌访问控制，默认为请求来源的ip）；
+//返回的任务已租出，fetcher需在租约到期前报告结果
+func (this *Scheduler) pullTasksHandler(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	result := types.JsonResult{}
+	max, err := strconv.Atoi(req.Form.Get("max"))
+	if err != nil || max <= 0 {
+		result.Err = ErrInputError
+		result.Msg = "missing or bad param `max`"
+		utils.OutputJsonResult(w, result)
+		return
+	}
+	if max > maxPullTasks {
+		max = maxPullTasks
+	}
+	fetcher := req.Form.Get("fetcher")
+	if fetcher == "" {
+		fetcher = req.RemoteAddr
+		if pos := strings.LastIndex(fetcher, ":"); pos > 0 {
+			fetcher = fetcher[:pos]
+		}
+	}
+
+	this.dispatchLock.Lock()
+	tasks, err := this.FetchTasks()
+	taskPacks := []types.TaskPack{}
+	if err == nil && len(tasks) > 0 {
+		sorter := lib.CrawlTaskSorter{Now: time.Now().Unix()}
+		sorter.Sort(tasks, nil)
+		taskPacks = this.leaseTasks(this.pickTasks(tasks, map[int32]bool{}, fetcher, max), fetcher)
+	}
+	this.dispatchLock.Unlock()
+
+	if err != nil {
+		result.Err = ErrDbError
+		result.Msg = err.Error()
+	} else {
+		log.Debugln("fetcher ", fetcher, " pull ", len(taskPacks), " tasks, max: ", max)
+		result.Err = ErrOk
+		result.Data = taskPacks
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//回收租约过期的任务，避免fetcher崩溃后任务一直处于抓取中
+func (this *Scheduler) ReapExpiredLeases() {
+	n, err := this.taskDao.ReclaimExpiredTasks()
+	if err != nil {
+		log.Errorln("reap expired leases error: ", err)
+	} else if n > 0 {
+		log.Warnln("reclaim ", n, " tasks with expired lease.")
+	}
 }
 
 /*
@@ -218,13 +621,24 @@ func (this *Scheduler) AddTasksFromRules() {
 func (this *Scheduler) httpService() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/report/task", this.reportTaskHandler)
+	mux.HandleFunc("/pull/tasks", this.pullTasksHandler)
+	mux.HandleFunc("/release/tasks", this.releaseTasksHandler)
+	mux.HandleFunc("/fetcher/register", this.registerFetcherHandler)
+	mux.HandleFunc("/fetcher/heartbeat", this.fetcherHeartbeatHandler)
+	mux.HandleFunc("/fetcher/unregister", this.unregisterFetcherHandler)
+	mux.HandleFunc("/admin/fetchers", this.fetchersHandler)
+	mux.HandleFunc("/report/links", this.reportLinksHandler)
+	mux.HandleFunc("/admin/failed_tasks", this.failedTasksHandler)
+	mux.HandleFunc("/history/task", this.taskHistoryHandler)
 	http.ListenAndServe(this.listenAddr, mux)
 }
 
+//fetcher报告任务完成情况，body为json格式的FetchReport，或FetchReport数组（批量报告）；
+//也兼容旧的task_id, done参数形式。
+//批量报告返回已处理（包括重复投递）的report_id列表，其余的由fetcher稍后重新投递
 func (this *Scheduler) reportTaskHandler(w http.ResponseWriter, req *http.Request) {
-	requiredParams := map[string]string{"task_id": "int", "done": "int"}
-	_, err := utils.CheckHttpParams(req, requiredParams)
 	result := types.JsonResult{}
+	reports, batch, err := this.parseReports(req)
 	if err != nil {
 		log.Errorln(err)
 		result.Err = ErrInputError
@@ -233,27 +647,446 @@ func (this *Scheduler) reportTaskHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	taskId := req.Form.Get("task_id")
-	intTaskId, _ := strconv.Atoi(taskId)
-	task := types.CrawlTask{Id: int32(intTaskId)}
+	accepted := []string{}
+	for i := range reports {
+		report := &reports[i]
+		if report.TaskId <= 0 {
+			//无法处理的报告也确认，避免fetcher反复投递
+			log.Errorln("drop report ", report.ReportId, " without task_id")
+			accepted = append(accepted, report.ReportId)
+			continue
+		}
+		err = this.applyReport(report)
+		if err != nil {
+			result.Err = ErrDbError
+			result.Msg = err.Error()
+			continue
+		}
+		accepted = append(accepted, report.ReportId)
+	}
+	if batch {
+		result.Err = ErrOk
+		result.Data = accepted
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//保存抓取记录并更新任务状态。report_id在抓取记录上唯一，先插入抓取记录，
+//插入失败说明报告已处理过，直接忽略，避免重复投递时crawl_times等被重复累加
+func (this *Scheduler) applyReport(report *types.FetchReport) error {
+	now := time.Now()
+	if report.FetchTime == 0 {
+		report.FetchTime = now.Unix()
+	}
+	if report.ReportId == "" {
+		//旧版fetcher的报告没有id，无法去重
+		report.ReportId = fmt.Sprintf("%d-%d", report.TaskId, now.UnixNano())
+	}
+	//近似标记随抓取记录保存，这里只读取上一版本的指纹，记录保存成功后再更新
+	var fingerprintTask *types.CrawlTask
+	if report.Done == types.FETCH_DONE && report.ContentHash != "" {
+		fingerprintTask = this.markNearDuplicate(report)
+	}
+	_, err := this.historyDao.AddHistory(types.CrawlHistory{FetchReport: *report, CreateTime: now})
+	if err == dao.ErrDuplicateReport {
+		log.Warnln("report ", report.ReportId, " of task ", report.TaskId, " has been processed, ignore it.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("save crawl history of task %d error: %v", report.TaskId, err)
+	}
+
+	task := types.CrawlTask{Id: report.TaskId}
 	tasks := []types.CrawlTask{task}
-	done := req.Form.Get("done")
 	var status dao.TaskStatus
-	if done == "1" {
+	switch report.Done {
+	case types.FETCH_DONE:
 		status = dao.TASK_FINISH
-	} else {
+	case types.FETCH_ROBOTS_DENIED:
+		status = dao.TASK_DENIED
+	default:
 		status = dao.TASK_FAILED
 	}
-	_, err = this.taskDao.SetTasksStatus(tasks, status)
+	if status == dao.TASK_FAILED && this.retryPolicy.ShouldRetry(report.ErrorClass, report.StatusCode) {
+		status, err = this.retryOrFail(task.Id)
+	} else {
+		_, err = this.taskDao.SetTasksStatus(tasks, status)
+	}
 	if err != nil {
-		msg := fmt.Sprintf("set task %s status to %d, error: %v", taskId, status, err)
+		msg := fmt.Sprintf("set task %d status to %d, error: %v", report.TaskId, status, err)
+		log.Errorln(msg)
+		//删除抓取记录，重新投递时再处理
+		this.historyDao.DeleteReport(report.ReportId)
+		return errors.New(msg)
+	}
+	log.Errorln("set task ", report.TaskId, " status to ", status, " finished.")
+	if fingerprintTask != nil {
+		this.updateFingerprint(fingerprintTask, report)
+	}
+	if report.PageKey != "" || report.DataKey != "" {
+		this.taskDao.SetTaskPageKeys(task.Id, report.PageKey, report.DataKey)
+	}
+	if report.Done == types.FETCH_DONE {
+		this.taskDao.SetTaskValidators(task.Id, report.Etag, report.LastModified)
+	}
+	return nil
+}
+
+//与上一版本比较SimHash得到近似标记，返回任务当前的指纹信息；读取任务失败时返回nil，不更新指纹
+func (this *Scheduler) markNearDuplicate(report *types.FetchReport) *types.CrawlTask {
+	task, err := this.taskDao.GetTaskById(report.TaskId)
+	if err != nil {
+		return nil
+	}
+	if !report.Unchanged && task.Simhash != 0 {
+		report.NearDuplicate = lib.SimHashDistance(task.Simhash, report.Simhash) <= this.simhashThreshold
+	}
+	return &task
+}
+
+//保存新的指纹，并查找其他domain上内容近似的镜像任务
+func (this *Scheduler) updateFingerprint(task *types.CrawlTask, report *types.FetchReport) {
+	duplicateOf, err := this.taskDao.FindNearDuplicate(task.Id, task.Domain, report.Simhash, this.simhashThreshold)
+	if err != nil {
+		duplicateOf = task.DuplicateOf
+	} else if duplicateOf > 0 && duplicateOf != task.DuplicateOf {
+		log.Infoln("task ", task.Id, " ", task.Domain, task.Urlpath, " looks like a mirror of task ", duplicateOf)
+	}
+	this.taskDao.SetTaskFingerprint(task.Id, report.ContentHash, report.Simhash, duplicateOf)
+}
+
+//解析报告，body为json数组时为批量报告
+func (this *Scheduler) parseReports(req *http.Request) ([]types.FetchReport, bool, error) {
+	report := types.FetchReport{}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, false, errors.New("read report error: " + err.Error())
+		}
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 && body[0] == '[' {
+			reports := []types.FetchReport{}
+			err = json.Unmarshal(body, &reports)
+			if err != nil {
+				return nil, true, errors.New("Unmarshal reports error: " + err.Error())
+			}
+			return reports, true, nil
+		}
+		err = json.Unmarshal(body, &report)
+		if err != nil {
+			return nil, false, errors.New("Unmarshal report error: " + err.Error())
+		}
+		if report.TaskId <= 0 {
+			return nil, false, errors.New("missing task_id in report")
+		}
+		return []types.FetchReport{report}, false, nil
+	}
+
+	requiredParams := map[string]string{"task_id": "int", "done": "int"}
+	_, err := utils.CheckHttpParams(req, requiredParams)
+	if err != nil {
+		return nil, false, err
+	}
+	taskId, _ := strconv.Atoi(req.Form.Get("task_id"))
+	report.TaskId = int32(taskId)
+	report.Done, _ = strconv.Atoi(req.Form.Get("done"))
+	report.PageKey = req.Form.Get("page_key")
+	report.DataKey = req.Form.Get("data_key")
+	return []types.FetchReport{report}, false, nil
+}
+
+//失败的任务在重试次数内按指数退避重新等待调度，否则置为最终失败
+func (this *Scheduler) retryOrFail(taskId int32) (dao.TaskStatus, error) {
+	task, err := this.taskDao.GetTaskById(taskId)
+	if err != nil {
+		return dao.TASK_FAILED, err
+	}
+	if this.retryPolicy.CanRetry(task.RetryTimes) {
+		delay := this.retryPolicy.NextDelay(task.RetryTimes)
+		log.Infoln("task ", taskId, " failed, retry ", task.RetryTimes+1, " after ", delay, " seconds.")
+		_, err = this.taskDao.SetTaskRetry(taskId, time.Now().Unix()+delay)
+		return dao.TASK_WAITING, err
+	}
+	log.Warnln("task ", taskId, " failed after ", task.RetryTimes, " retries, give up.")
+	_, err = this.taskDao.SetTasksStatus([]types.CrawlTask{task}, dao.TASK_FAILED)
+	return dao.TASK_FAILED, err
+}
+
+//fetcher退出时交还未开始的任务，参数task_ids为json数组；只释放仍在抓取中的任务
+func (this *Scheduler) releaseTasksHandler(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	result := types.JsonResult{}
+	taskIds := []int32{}
+	err := json.Unmarshal([]byte(req.Form.Get("task_ids")), &taskIds)
+	if err != nil || len(taskIds) == 0 {
+		result.Err = ErrInputError
+		result.Msg = "missing or bad param `task_ids`"
+		utils.OutputJsonResult(w, result)
+		return
+	}
+	n, err := this.taskDao.ReleaseTasks(taskIds)
+	if err != nil {
+		result.Err = ErrDbError
+		result.Msg = err.Error()
+	} else {
+		log.Infoln("fetcher ", req.RemoteAddr, " hand back ", len(taskIds), " tasks, released: ", n)
+		result.Err = ErrOk
+		result.Data = n
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//fetcher启动时注册，body为json格式的FetcherInfo
+func (this *Scheduler) registerFetcherHandler(w http.ResponseWriter, req *http.Request) {
+	result := types.JsonResult{}
+	info, err := parseFetcherInfo(req)
+	if err != nil {
+		result.Err = ErrInputError
+		result.Msg = err.Error()
+	} else {
+		this.registry.Touch(info, time.Now())
+		log.Infoln("fetcher ", info.Addr, " registered, workers: ", info.Workers, ", queue size: ", info.QueueSize)
+		result.Err = ErrOk
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//fetcher定期发送心跳，body同注册；scheduler重启后心跳会重新注册fetcher
+func (this *Scheduler) fetcherHeartbeatHandler(w http.ResponseWriter, req *http.Request) {
+	result := types.JsonResult{}
+	info, err := parseFetcherInfo(req)
+	if err != nil {
+		result.Err = ErrInputError
+		result.Msg = err.Error()
+	} else {
+		if this.registry.Touch(info, time.Now()) {
+			log.Infoln("fetcher ", info.Addr, " registered by heartbeat.")
+		}
+		result.Err = ErrOk
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//fetcher退出时注销，参数：addr
+func (this *Scheduler) unregisterFetcherHandler(w http.ResponseWriter, req *http.Request) {
+	result := types.JsonResult{}
+	_, err := utils.CheckHttpParams(req, map[string]string{"addr": "string"})
+	if err != nil {
+		result.Err = ErrInputError
+		result.Msg = err.Error()
+	} else {
+		addr := req.Form.Get("addr")
+		if this.registry.Unregister(addr) {
+			log.Infoln("fetcher ", addr, " unregistered.")
+		}
+		result.Err = ErrOk
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//查看注册的fetcher及其是否可用
+func (this *Scheduler) fetchersHandler(w http.ResponseWriter, req *http.Request) {
+	result := types.JsonResult{Err: ErrOk, Data: this.registry.All(time.Now())}
+	utils.OutputJsonResult(w, result)
+}
+
+func parseFetcherInfo(req *http.Request) (types.FetcherInfo, error) {
+	info := types.FetcherInfo{}
+	err := json.NewDecoder(req.Body).Decode(&info)
+	if err != nil {
+		return info, errors.New("Unmarshal fetcher info error: " + err.Error())
+	}
+	if info.Addr == "" {
+		return info, errors.New("missing addr in fetcher info")
+	}
+	return info, nil
+}
+
+//列出重试次数用完、最终失败的任务，参数offset, limit
+func (this *Scheduler) failedTasksHandler(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	offset, _ := strconv.Atoi(req.Form.Get("offset"))
+	limit, err := strconv.Atoi(req.Form.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	result := types.JsonResult{}
+	tasks, err := this.taskDao.GetFailedTasks(offset, limit)
+	if err != nil {
+		result.Err = ErrDbError
+		result.Msg = "get failed tasks error: " + err.Error()
+	} else {
+		result.Err = ErrOk
+		result.Data = tasks
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//查询任务的抓取历史，参数task_id或url（domain+urlpath），以及offset, limit
+func (this *Scheduler) taskHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	offset, _ := strconv.Atoi(req.Form.Get("offset"))
+	limit, err := strconv.Atoi(req.Form.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	result := types.JsonResult{}
+
+	var task types.CrawlTask
+	if taskId, err1 := strconv.Atoi(req.Form.Get("task_id")); err1 == nil {
+		task, err = this.taskDao.GetTaskById(int32(taskId))
+	} else if link := req.Form.Get("url"); link != "" {
+		domain, urlpath, err1 := splitLink(link)
+		if err1 != nil {
+			result.Err = ErrInputError
+			result.Msg = "bad url: " + err1.Error()
+			utils.OutputJsonResult(w, result)
+			return
+		}
+		task, err = this.taskDao.GetTaskByUrl(domain, urlpath)
+	} else {
+		result.Err = ErrInputError
+		result.Msg = "missing http param: task_id or url"
+		utils.OutputJsonResult(w, result)
+		return
+	}
+	if err != nil {
+		result.Err = ErrDbError
+		result.Msg = "get task error: " + err.Error()
+		utils.OutputJsonResult(w, result)
+		return
+	}
+
+	history := types.TaskHistory{Task: task}
+	history.Attempts, err = this.historyDao.GetTaskHistory(task.Id, offset, limit)
+	if err == nil {
+		history.LastSuccess, err = this.historyDao.GetLastSuccess(task.Id)
+	}
+	if err == nil {
+		var sinceId int64 = 0
+		if history.LastSuccess != nil {
+			sinceId = history.LastSuccess.Id
+		}
+		history.FailuresSinceSuccess, err = this.historyDao.CountFailuresSince(task.Id, sinceId)
+	}
+	if err != nil {
+		result.Err = ErrDbError
+		result.Msg = "get crawl history error: " + err.Error()
+	} else {
+		result.Err = ErrOk
+		result.Data = history
+	}
+	utils.OutputJsonResult(w, result)
+}
+
+//fetcher报告页面中发现的链接，作为新任务入库，优先级和周期继承自父任务；
+//只接受父任务站点和link_domains中站点的链接，已存在的任务不变
+func (this *Scheduler) reportLinksHandler(w http.ResponseWriter, req *http.Request) {
+	requiredParams := map[string]string{"task_id": "int", "links": "string"}
+	_, err := utils.CheckHttpParams(req, requiredParams)
+	result := types.JsonResult{}
+	if err != nil {
+		log.Errorln(err)
+		result.Err = ErrInputError
+		result.Msg = err.Error()
+		utils.OutputJsonResult(w, result)
+		return
+	}
+
+	taskId, _ := strconv.Atoi(req.Form.Get("task_id"))
+	links := []string{}
+	err = json.Unmarshal([]byte(req.Form.Get("links")), &links)
+	if err != nil {
+		msg := "Unmarshal links error: " + err.Error()
+		log.Errorln(msg)
+		result.Err = ErrDataError
+		result.Msg = msg
+		utils.OutputJsonResult(w, result)
+		return
+	}
+
+	parent, err := this.taskDao.GetTaskById(int32(taskId))
+	if err != nil {
+		msg := fmt.Sprintf("get parent task %d error: %v", taskId, err)
 		log.Errorln(msg)
 		result.Err = ErrDbError
 		result.Msg = msg
+		utils.OutputJsonResult(w, result)
+		return
+	}
+
+	crawlTasks := []types.CrawlTask{}
+	for _, link := range links {
+		domain, urlpath, err := splitLink(link)
+		if err != nil {
+			log.Warnln("skip bad link ", link, ": ", err)
+			continue
+		}
+		if !this.linkAllowed(parent.Domain, domain) {
+			log.Debugln("skip link ", link, " out of allowed domains")
+			continue
+		}
+		crawlTasks = append(crawlTasks, this.taskDao.ConvertLinkToTask(parent, domain, urlpath))
+	}
 
+	var num int64
+	if len(crawlTasks) > 0 {
+		num, err = this.taskDao.AddLinkTasks(crawlTasks)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("add tasks from links of task %d error: %v", taskId, err)
+		log.Errorln(msg)
+		result.Err = ErrDbError
+		result.Msg = msg
 	} else {
-		log.Errorln("set task ", taskId, " status to ", status, " finished.")
+		log.Infoln("add ", num, " tasks from links of task ", taskId)
 		result.Err = ErrOk
+		result.Data = num
 	}
 	utils.OutputJsonResult(w, result)
 }
+
+//链接的站点和父任务相同（忽略协议），或者是link_domains中的站点或其子域名
+func (this *Scheduler) linkAllowed(parentDomain string, domain string) bool {
+	host := linkHost(domain)
+	if host == linkHost(parentDomain) {
+		return true
+	}
+	for _, allowed := range this.linkDomains {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+//去掉协议和端口，host统一为小写
+func linkHost(domain string) string {
+	if pos := strings.Index(domain, "//"); pos >= 0 {
+		domain = domain[pos+2:]
+	}
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	return strings.ToLower(strings.TrimSuffix(domain, "/"))
+}
+
+//把绝对地址拆成domain(含协议)和urlpath(含query)，超过任务表字段长度的链接返回错误
+func splitLink(link string) (string, string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", "", fmt.Errorf("not an absolute url")
+	}
+	domain, urlpath := u.Scheme+"://"+u.Host, u.RequestURI()
+	if utf8.RuneCountInString(domain) > dao.TaskDomainMaxLen {
+		return "", "", fmt.Errorf("domain longer than %d", dao.TaskDomainMaxLen)
+	}
+	if utf8.RuneCountInString(urlpath) > dao.TaskUrlpathMaxLen {
+		return "", "", fmt.Errorf("urlpath longer than %d", dao.TaskUrlpathMaxLen)
+	}
+	return domain, urlpath, nil
+}
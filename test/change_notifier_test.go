@@ -0,0 +1,136 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhaozhi406/crawler/fetcher"
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+func TestDetectPageChange(t *testing.T) {
+	oldPage := []byte("<html><body><p>price: 10</p><p>in stock</p></body></html>")
+	newPage := []byte("<html><body><p>price: 12</p><p>in stock</p></body></html>")
+	summary, changed := fetcher.DetectPageChange(oldPage, newPage)
+	if !changed || summary.Added != 1 || summary.Removed != 1 {
+		t.Fatal("unexpected summary: ", summary)
+	}
+	if summary.AddedLines[0] != "price: 12" || summary.RemovedLines[0] != "price: 10" {
+		t.Error("unexpected lines: ", summary.AddedLines, summary.RemovedLines)
+	}
+	if _, changed = fetcher.DetectPageChange(oldPage, oldPage); changed {
+		t.Error("same page should not change")
+	}
+}
+
+//webhook前两次返回500，之后成功，事件应被重试直到投递成功
+func TestChangeNotifierRetry(t *testing.T) {
+	var calls int32
+	received := make(chan types.ChangeEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		event := types.ChangeEvent{}
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			t.Error("decode event error: ", err)
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	notifier, err := fetcher.InitChangeNotifier(&lib.HttpClient{}, server.URL, "", 10, 10*time.Millisecond, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go notifier.Run()
+	defer notifier.Stop()
+
+	notifier.Notify("", types.ChangeEvent{TaskId: 7, Url: "http://example.com/", Watch: types.WATCH_PAGE})
+	select {
+	case event := <-received:
+		if event.TaskId != 7 || event.Url != "http://example.com/" {
+			t.Error("unexpected event: ", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not delivered, calls: ", atomic.LoadInt32(&calls))
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Error("expect 3 calls, got ", n)
+	}
+}
+
+//webhook不可用时Notify不阻塞，超过积压上限的事件被丢弃；未投递的事件重启后继续投递
+func TestChangeNotifierPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes.outbox")
+
+	var up int32
+	received := make(chan types.ChangeEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		event := types.ChangeEvent{}
+		json.NewDecoder(req.Body).Decode(&event)
+		received <- event
+	}))
+	defer server.Close()
+
+	notifier, err := fetcher.InitChangeNotifier(&lib.HttpClient{}, server.URL, path, 2, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go notifier.Run()
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		notifier.Notify("", types.ChangeEvent{TaskId: int32(i)})
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Notify should not block")
+	}
+	if n := notifier.Pending(); n != 2 {
+		t.Error("expect 2 pending events, got ", n)
+	}
+	notifier.Stop()
+
+	atomic.StoreInt32(&up, 1)
+	notifier, err = fetcher.InitChangeNotifier(&lib.HttpClient{}, server.URL, path, 2, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := notifier.Pending(); n != 2 {
+		t.Fatal("expect 2 replayed events, got ", n)
+	}
+	go notifier.Run()
+	for _, taskId := range []int32{1, 2} {
+		select {
+		case event := <-received:
+			if event.TaskId != taskId {
+				t.Error("expect event of task ", taskId, ", got ", event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("replayed event not delivered")
+		}
+	}
+	notifier.Stop()
+
+	notifier, _ = fetcher.InitChangeNotifier(&lib.HttpClient{}, server.URL, path, 2, time.Hour, time.Hour)
+	if n := notifier.Pending(); n != 0 {
+		t.Error("expect no pending events after delivery, got ", n)
+	}
+}
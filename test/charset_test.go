@@ -0,0 +1,46 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/zhaozhi406/crawler/lib"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+func TestDecodeHtml(t *testing.T) {
+	httpClient := &lib.HttpClient{}
+	gbk, _ := simplifiedchinese.GBK.NewEncoder().String("<html><body>中文网页，这是一个测试页面。</body></html>")
+	big5, _ := traditionalchinese.Big5.NewEncoder().String("<html><body>這是一個繁體中文的測試頁面。</body></html>")
+	sjis, _ := japanese.ShiftJIS.NewEncoder().String("<html><body>これは日本語のテストページです。</body></html>")
+	eucjp, _ := japanese.EUCJP.NewEncoder().String("<html><body>これは日本語のテストページです。</body></html>")
+	metaGbk, _ := simplifiedchinese.GBK.NewEncoder().String(`<html><head><meta http-equiv="Content-Type" content="text/html; charset=gbk"></head><body>中文</body></html>`)
+
+	cases := []struct {
+		html        string
+		contentType string
+		charset     string
+		expect      string
+	}{
+		{gbk, "text/html; charset=GBK", "gbk", "<html><body>中文网页，这是一个测试页面。</body></html>"},
+		{"\xef\xbb\xbf<p>utf8</p>", "text/html", "utf-8", "<p>utf8</p>"},
+		{metaGbk, "text/html", "gbk", `<html><head><meta http-equiv="Content-Type" content="text/html; charset=gbk"></head><body>中文</body></html>`},
+		{gbk, "", "gb18030", "<html><body>中文网页，这是一个测试页面。</body></html>"},
+		{big5, "", "big5", "<html><body>這是一個繁體中文的測試頁面。</body></html>"},
+		{sjis, "", "shift_jis", "<html><body>これは日本語のテストページです。</body></html>"},
+		{eucjp, "", "euc-jp", "<html><body>これは日本語のテストページです。</body></html>"},
+	}
+	for i, c := range cases {
+		decoded, charset, err := httpClient.DecodeHtml([]byte(c.html), c.contentType)
+		if err != nil {
+			t.Error(i, " decode error: ", err)
+		}
+		if charset != c.charset {
+			t.Error(i, " expect charset ", c.charset, ", got ", charset)
+		}
+		if string(decoded) != c.expect {
+			t.Error(i, " unexpected decoded html: ", string(decoded))
+		}
+	}
+}
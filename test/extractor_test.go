@@ -0,0 +1,52 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zhaozhi406/crawler/fetcher"
+)
+
+var extractorPage = []byte(`<html><head><title> Example Title </title></head><body>
+<ul><li class="item">one</li><li class="item"> two </li></ul>
+<a href="/next">next page</a>
+</body></html>`)
+
+//只有一个xpath时结果放在默认字段中
+func TestExtractFieldsSingleXpath(t *testing.T) {
+	fields, err := fetcher.ExtractFields(extractorPage, " //li[@class='item'] ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{fetcher.DefaultFieldName: {"one", "two"}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Error("unexpected fields: ", fields)
+	}
+}
+
+//json形式按字段名分别抽取，没有匹配的字段为空列表
+func TestExtractFieldsJsonMap(t *testing.T) {
+	fields, err := fetcher.ExtractFields(extractorPage, `{"title": "//title", "next": "//a/@href", "missing": "//table"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"title":   {"Example Title"},
+		"next":    {"/next"},
+		"missing": {}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Error("unexpected fields: ", fields)
+	}
+}
+
+func TestExtractFieldsInvalid(t *testing.T) {
+	if _, err := fetcher.ExtractFields(extractorPage, "//li[@class="); err == nil {
+		t.Error("expect error for invalid xpath")
+	}
+	if _, err := fetcher.ExtractFields(extractorPage, `{"title": "//title"`); err == nil {
+		t.Error("expect error for invalid json")
+	}
+	if _, err := fetcher.ExtractFields(extractorPage, `{"title": "//title", "bad": "//li["}`); err == nil {
+		t.Error("expect error for invalid xpath in json")
+	}
+}
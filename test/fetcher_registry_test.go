@@ -0,0 +1,58 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhaozhi406/crawler/scheduler"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+func TestFetcherRegistryHeartbeat(t *testing.T) {
+	registry := scheduler.InitFetcherRegistry(30 * time.Second)
+	if !registry.Empty() || registry.Used() {
+		t.Fatal("new registry should be empty")
+	}
+	now := time.Unix(1500000000, 0)
+	if !registry.Touch(types.FetcherInfo{Addr: "b:9191", Workers: 2, QueueSize: 100}, now) {
+		t.Error("first touch should register the fetcher")
+	}
+	registry.Touch(types.FetcherInfo{Addr: "a:9191", Workers: 4, QueueSize: 50}, now)
+
+	//b的心跳在20秒后更新，a的心跳超时
+	if registry.Touch(types.FetcherInfo{Addr: "b:9191", Workers: 2, QueueSize: 200}, now.Add(20*time.Second)) {
+		t.Error("heartbeat should not register again")
+	}
+	live := registry.Live(now.Add(40 * time.Second))
+	if len(live) != 1 || live[0].Addr != "b:9191" || live[0].QueueSize != 200 || live[0].RegisterTime != now.Unix() {
+		t.Fatal("unexpected live fetchers: ", live)
+	}
+	all := registry.All(now.Add(40 * time.Second))
+	if len(all) != 2 || all[0].Addr != "a:9191" || all[0].Live {
+		t.Error("lapsed fetcher should be listed as not live: ", all)
+	}
+
+	//a恢复心跳
+	registry.Touch(types.FetcherInfo{Addr: "a:9191", Workers: 4, QueueSize: 50}, now.Add(45*time.Second))
+	if live = registry.Live(now.Add(45 * time.Second)); len(live) != 2 {
+		t.Error("expect 2 live fetchers, got ", live)
+	}
+
+	//推送的任务在下次心跳前从空闲位置中扣除
+	registry.Touch(types.FetcherInfo{Addr: "a:9191", Workers: 4, QueueSize: 50, FreeSlots: 30}, now.Add(50*time.Second))
+	registry.Reserve("a:9191", 20)
+	registry.Reserve("a:9191", 20)
+	if live = registry.Live(now.Add(50 * time.Second)); live[0].FreeSlots != 0 {
+		t.Error("expect no free slots after reserve, got ", live[0].FreeSlots)
+	}
+
+	registry.Unregister("a:9191")
+	registry.Unregister("b:9191")
+	if !registry.Empty() || len(registry.Live(now.Add(50*time.Second))) != 0 {
+		t.Error("registry should be empty after unregister")
+	}
+	//注销后仍视为使用过注册，scheduler不会回到静态配置的fetchers
+	if !registry.Used() {
+		t.Error("registry should stay used after all fetchers unregister")
+	}
+}
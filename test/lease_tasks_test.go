@@ -0,0 +1,111 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/zhaozhi406/crawler/dao"
+)
+
+//需要CRAWLER_TEST_DSN指定按conf/schema.sql建好表的mysql，返回连接和本次测试使用的domain，测试结束时删除该domain的任务
+func leaseTestDb(t *testing.T) (*sqlx.DB, string) {
+	dsn := os.Getenv("CRAWLER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("CRAWLER_TEST_DSN is not set")
+	}
+	db, err := sqlx.Connect("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := fmt.Sprintf("http://lease-%d.example.com", time.Now().UnixNano())
+	return db, domain
+}
+
+func cleanLeaseTestDb(db *sqlx.DB, domain string) {
+	db.Exec("delete from "+dao.TaskTable+" where domain=?", domain)
+	db.Close()
+}
+
+//插入一个任务，返回任务id
+func insertLeaseTestTask(t *testing.T, db *sqlx.DB, domain string, urlpath string, status dao.TaskStatus, cycle int, lastCrawlTime int64) int32 {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	result, err := db.Exec("insert into "+dao.TaskTable+" (domain, urlpath, xpath, status, cycle, last_crawl_time, create_time, update_time) values (?, ?, '', ?, ?, ?, ?, ?)", domain, urlpath, status, cycle, lastCrawlTime, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return int32(id)
+}
+
+//多个fetcher同时拉取时，同一个任务只能被租出一次
+func TestLeaseTasksConcurrent(t *testing.T) {
+	db, domain := leaseTestDb(t)
+	defer cleanLeaseTestDb(db, domain)
+	taskIds := []int32{}
+	for i := 0; i < 20; i++ {
+		taskIds = append(taskIds, insertLeaseTestTask(t, db, domain, fmt.Sprintf("/%d", i), dao.TASK_WAITING, 0, 0))
+	}
+
+	taskDao := dao.InitTaskDao(db)
+	lock := sync.Mutex{}
+	leasedBy := map[int32]int{}
+	wg := sync.WaitGroup{}
+	for puller := 0; puller < 4; puller++ {
+		wg.Add(1)
+		go func(puller int) {
+			defer wg.Done()
+			leased, err := taskDao.LeaseTasks(taskIds, time.Now().Add(time.Minute).Unix())
+			if err != nil {
+				t.Error("lease tasks error: ", err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, taskId := range leased {
+				if other, ok := leasedBy[taskId]; ok {
+					t.Error("task ", taskId, " is leased by ", other, " and ", puller)
+				}
+				leasedBy[taskId] = puller
+			}
+		}(puller)
+	}
+	wg.Wait()
+	if len(leasedBy) != len(taskIds) {
+		t.Error("expect ", len(taskIds), " leased tasks, got ", len(leasedBy))
+	}
+}
+
+//到期的周期任务可以再次租出；未到期的周期任务和已完成的一次性任务不能
+func TestLeaseRecurringTasks(t *testing.T) {
+	db, domain := leaseTestDb(t)
+	defer cleanLeaseTestDb(db, domain)
+	now := time.Now().Unix()
+	due := insertLeaseTestTask(t, db, domain, "/due", dao.TASK_FINISH, 60, now-120)
+	notDue := insertLeaseTestTask(t, db, domain, "/not-due", dao.TASK_FINISH, 60, now)
+	once := insertLeaseTestTask(t, db, domain, "/once", dao.TASK_FINISH, 0, now-120)
+
+	taskDao := dao.InitTaskDao(db)
+	waiting, err := taskDao.GetWaitingTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := map[int32]bool{}
+	for _, task := range waiting {
+		selected[task.Id] = true
+	}
+	if !selected[due] || selected[notDue] || selected[once] {
+		t.Error("expect only the due recurring task to be waiting, got ", selected[due], selected[notDue], selected[once])
+	}
+
+	leased, err := taskDao.LeaseTasks([]int32{due, notDue, once}, now+60)
+	if err != nil || len(leased) != 1 || leased[0] != due {
+		t.Fatal("expect only the due recurring task leased, got ", leased, err)
+	}
+	//已租出的任务不能再次租出
+	if leased, _ = taskDao.LeaseTasks([]int32{due}, now+60); len(leased) != 0 {
+		t.Error("leased task is leased again: ", leased)
+	}
+}
@@ -0,0 +1,44 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zhaozhi406/crawler/fetcher"
+)
+
+//相对链接按页面地址（或<base>）转为绝对地址，去掉锚点并去重，忽略纯锚点和非http(s)链接
+func TestExtractLinks(t *testing.T) {
+	page := []byte(`<html><body>
+<a href="/a">a</a>
+<a href="b?x=1#top">b</a>
+<a href=" /a#part ">a again</a>
+<a href="#top">anchor</a>
+<a href="">empty</a>
+<a href="mailto:someone@example.com">mail</a>
+<a href="javascript:void(0)">js</a>
+<a href="ftp://example.com/file">ftp</a>
+<a href="https://other.example.com/c">c</a>
+<a name="no-href">no href</a>
+</body></html>`)
+	links := fetcher.ExtractLinks(page, "http://www.example.com/dir/index.html")
+	expected := []string{
+		"http://www.example.com/a",
+		"http://www.example.com/dir/b?x=1",
+		"https://other.example.com/c"}
+	if !reflect.DeepEqual(links, expected) {
+		t.Error("unexpected links: ", links)
+	}
+}
+
+func TestExtractLinksBase(t *testing.T) {
+	page := []byte(`<head><base href="http://cdn.example.com/pages/"></head><a href="p1">p1</a><a href="../p2">p2</a>`)
+	links := fetcher.ExtractLinks(page, "http://www.example.com/")
+	expected := []string{"http://cdn.example.com/pages/p1", "http://cdn.example.com/p2"}
+	if !reflect.DeepEqual(links, expected) {
+		t.Error("unexpected links: ", links)
+	}
+	if links := fetcher.ExtractLinks(page, "://bad url"); len(links) != 0 {
+		t.Error("expect no links with bad base url, got ", links)
+	}
+}
@@ -0,0 +1,117 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhaozhi406/crawler/fetcher"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+func TestLocalPageStoreVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "page_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := fetcher.InitLocalPageStore(dir, "")
+
+	if _, _, err = store.Latest("http://example.com", "/a"); err != fetcher.ErrPageNotFound {
+		t.Fatal("expect ErrPageNotFound, got ", err)
+	}
+	key, err := store.Save("http://example.com", "/a", []byte("<p>v1</p>"), types.PageMeta{TaskId: 3, StatusCode: 200, Headers: map[string][]string{"Etag": {"\"v1\""}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.LoadMeta(key)
+	if err != nil || meta.TaskId != 3 || meta.Headers["Etag"][0] != "\"v1\"" {
+		t.Fatal("unexpected meta: ", meta, err)
+	}
+	//Save以秒级时间戳为版本，手工放一个更旧的版本
+	pageDir := filepath.Dir(key)
+	ioutil.WriteFile(filepath.Join(pageDir, "1000"), []byte("<p>v0</p>"), 0666)
+	store.SaveExtracted("http://example.com", "/a", []byte("{}"))
+
+	versions, err := store.ListVersions("http://example.com", "/a")
+	if err != nil || len(versions) != 2 || versions[0] != 1000 {
+		t.Fatal("unexpected versions: ", versions, err)
+	}
+	page, err := store.Get("http://example.com", "/a", 1000)
+	if err != nil || string(page) != "<p>v0</p>" {
+		t.Error("unexpected page: ", string(page), err)
+	}
+	version, page, err := store.Latest("http://example.com", "/a")
+	if err != nil || version != versions[1] || string(page) != "<p>v1</p>" {
+		t.Error("unexpected latest: ", version, string(page), err)
+	}
+	if _, err = store.Get("http://example.com", "/a", 1); err != fetcher.ErrPageNotFound {
+		t.Error("expect ErrPageNotFound, got ", err)
+	}
+}
+
+func TestLocalPageStoreCompressAndSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "page_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := fetcher.InitLocalPageStore(dir, "zstd")
+
+	key, err := store.Save("http://example.com", "/b", []byte("<p>latest</p>"), types.PageMeta{TaskId: 4})
+	if err != nil || filepath.Ext(key) != ".zst" {
+		t.Fatal("unexpected key: ", key, err)
+	}
+	page, err := store.Load(key)
+	if err != nil || string(page) != "<p>latest</p>" {
+		t.Fatal("unexpected page: ", string(page), err)
+	}
+	if meta, err := store.LoadMeta(key); err != nil || meta.TaskId != 4 {
+		t.Fatal("unexpected meta: ", meta, err)
+	}
+
+	//放几个很旧的版本，包括未压缩的和带元数据、抽取结果的
+	pageDir := filepath.Dir(key)
+	for _, name := range []string{"1000", "1000.meta.json", "1000.json", "2000.gz", "2000.meta.json", "3000"} {
+		ioutil.WriteFile(filepath.Join(pageDir, name), []byte("old"), 0666)
+	}
+	stats, err := store.Sweep(2, 0)
+	if err != nil || stats.VersionsRemoved != 2 || stats.FilesRemoved != 5 {
+		t.Fatal("unexpected stats: ", stats, err)
+	}
+	versions, _ := store.ListVersions("http://example.com", "/b")
+	if len(versions) != 2 || versions[0] != 3000 {
+		t.Error("unexpected versions: ", versions)
+	}
+
+	//按天数保留，最新版本总是保留
+	stats, _ = store.Sweep(0, time.Hour)
+	versions, _ = store.ListVersions("http://example.com", "/b")
+	if stats.VersionsRemoved != 1 || len(versions) != 1 {
+		t.Error("unexpected sweep by age: ", stats, versions)
+	}
+}
+
+//未知的压缩方式按不压缩保存，页面和元数据都能读出
+func TestLocalPageStoreUnknownCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "page_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := fetcher.InitLocalPageStore(dir, "bogus")
+
+	key, err := store.Save("http://example.com", "/c", []byte("<p>c</p>"), types.PageMeta{TaskId: 5})
+	if err != nil || filepath.Ext(key) != "" {
+		t.Fatal("unexpected key: ", key, err)
+	}
+	if meta, err := store.LoadMeta(key); err != nil || meta.TaskId != 5 {
+		t.Error("unexpected meta: ", meta, err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(key))
+	if len(files) != 2 {
+		t.Error("expect page and meta files, got ", len(files))
+	}
+}
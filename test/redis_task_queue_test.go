@@ -0,0 +1,182 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//只支持任务队列用到的list命令的redis替身，list的第0个元素为左端
+type fakeRedis struct {
+	lock  sync.Mutex
+	lists map[string][]string
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRedis{lists: map[string][]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, listener
+}
+
+func (this *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRespCommand(reader)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(this.exec(args)))
+	}
+}
+
+func readRespCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := []string{}
+	for i := 0; i < n; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (this *fakeRedis) exec(args []string) string {
+	cmd := strings.ToLower(args[0])
+	if cmd == "brpoplpush" {
+		timeout, _ := strconv.Atoi(args[3])
+		deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+		for {
+			if reply := this.exec([]string{"rpoplpush", args[1], args[2]}); reply != "$-1\r\n" || time.Now().After(deadline) {
+				return reply
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	switch cmd {
+	case "ping":
+		return "+PONG\r\n"
+	case "lpush":
+		for _, val := range args[2:] {
+			this.lists[args[1]] = append([]string{val}, this.lists[args[1]]...)
+		}
+		return fmt.Sprintf(":%d\r\n", len(this.lists[args[1]]))
+	case "rpoplpush":
+		src := this.lists[args[1]]
+		if len(src) == 0 {
+			return "$-1\r\n"
+		}
+		val := src[len(src)-1]
+		this.lists[args[1]] = src[:len(src)-1]
+		this.lists[args[2]] = append([]string{val}, this.lists[args[2]]...)
+		return bulk(val)
+	case "lrem":
+		list := this.lists[args[1]]
+		for i, val := range list {
+			if val == args[3] {
+				this.lists[args[1]] = append(list[:i:i], list[i+1:]...)
+				return ":1\r\n"
+			}
+		}
+		return ":0\r\n"
+	case "llen":
+		return fmt.Sprintf(":%d\r\n", len(this.lists[args[1]]))
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+func TestRedisTaskQueue(t *testing.T) {
+	server, listener := startFakeRedis(t)
+	defer listener.Close()
+	redisPool, err := pool.New("tcp", listener.Addr().String(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := lib.InitRedisTaskQueue(redisPool, "test:tasks")
+	queueKey := queue.QueueKey("fetcher1:9191")
+	processingKey := queue.ProcessingKey("fetcher1:9191")
+
+	err = queue.Push(queueKey, []types.TaskPack{{TaskId: 1, Domain: "http://a.com", Urlpath: "/"}, {TaskId: 2, Domain: "http://b.com", Urlpath: "/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := queue.Len(queueKey); n != 2 {
+		t.Fatal("expect 2 tasks in queue, got ", n)
+	}
+
+	//先进先出，取出的任务进入processing list
+	pack, raw, err := queue.Pop(queueKey, processingKey, 1)
+	if err != nil || pack == nil || pack.TaskId != 1 {
+		t.Fatal("unexpected pop: ", pack, err)
+	}
+	if n, _ := queue.Len(processingKey); n != 1 {
+		t.Fatal("expect 1 task in processing, got ", n)
+	}
+
+	//模拟fetcher重启：未完成的任务放回队列
+	n, err := queue.Recover(processingKey, queueKey)
+	if err != nil || n != 1 {
+		t.Fatal("unexpected recover: ", n, err)
+	}
+	for _, expect := range []int32{2, 1} {
+		pack, raw, err = queue.Pop(queueKey, processingKey, 1)
+		if err != nil || pack == nil || pack.TaskId != expect {
+			t.Fatal("unexpected pop: ", pack, err, ", expect task ", expect)
+		}
+		if err = queue.Ack(processingKey, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.lock.Lock()
+	left := len(server.lists[processingKey]) + len(server.lists[queueKey])
+	server.lock.Unlock()
+	if left != 0 {
+		t.Error("expect empty lists, left: ", left)
+	}
+
+	//队列为空时超时返回nil
+	pack, _, err = queue.Pop(queueKey, processingKey, 1)
+	if err != nil || pack != nil {
+		t.Error("expect nil on timeout, got ", pack, err)
+	}
+}
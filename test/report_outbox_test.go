@@ -0,0 +1,93 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhaozhi406/crawler/fetcher"
+	"github.com/zhaozhi406/crawler/lib"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+func waitOutboxEmpty(t *testing.T, outbox *fetcher.ReportOutbox) {
+	deadline := time.Now().Add(2 * time.Second)
+	for outbox.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("reports not delivered, pending: ", outbox.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//scheduler不可用时报告保存在outbox中，重启后重新发送；scheduler每批只确认第一个报告，其余的应被重新投递
+func TestReportOutboxRedelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reports.outbox")
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"err":1003,"msg":"db error"}`))
+	}))
+	outbox, err := fetcher.InitReportOutbox(path, &lib.HttpClient{}, down.URL, 2, 10*time.Millisecond, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go outbox.Run()
+	for i := 1; i <= 3; i++ {
+		outbox.Add(types.FetchReport{TaskId: int32(i), Done: types.FETCH_DONE})
+	}
+	time.Sleep(50 * time.Millisecond)
+	outbox.Stop()
+	down.Close()
+
+	lock := sync.Mutex{}
+	accepted := map[string]int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reports := []types.FetchReport{}
+		if err := json.NewDecoder(req.Body).Decode(&reports); err != nil || len(reports) == 0 || len(reports) > 2 {
+			t.Error("unexpected batch: ", reports, err)
+			return
+		}
+		lock.Lock()
+		if _, ok := accepted[reports[0].ReportId]; ok {
+			t.Error("report is delivered again after accepted: ", reports[0])
+		}
+		accepted[reports[0].ReportId] = reports[0].TaskId
+		lock.Unlock()
+		result := types.JsonResult{Data: []string{reports[0].ReportId}}
+		jsonBytes, _ := json.Marshal(result)
+		w.Write(jsonBytes)
+	}))
+	defer server.Close()
+
+	outbox, err = fetcher.InitReportOutbox(path, &lib.HttpClient{}, server.URL, 2, 10*time.Millisecond, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Pending() != 3 {
+		t.Fatal("expect 3 reports in outbox, got ", outbox.Pending())
+	}
+	go outbox.Run()
+	waitOutboxEmpty(t, outbox)
+	outbox.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(accepted) != 3 {
+		t.Error("expect 3 accepted reports, got ", accepted)
+	}
+	outbox, _ = fetcher.InitReportOutbox(path, &lib.HttpClient{}, server.URL, 2, time.Second, time.Second)
+	if outbox.Pending() != 0 {
+		t.Error("expect no pending reports after restart, got ", outbox.Pending())
+	}
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zhaozhi406/crawler/lib"
+)
+
+func TestRobotsAllowed(t *testing.T) {
+	content := `
+# comment
+User-agent: *
+Disallow: /private/
+Allow: /private/public.html
+Disallow: /*.php$
+
+User-agent: crawler
+User-agent: other
+Disallow: /tmp
+Crawl-delay: 5
+`
+	robots := lib.ParseRobots([]byte(content))
+	cases := []struct {
+		agent   string
+		urlpath string
+		allowed bool
+	}{
+		{"somebot", "/index.html", true},
+		{"somebot", "/private/a.html", false},
+		{"somebot", "/private/public.html", true},
+		{"somebot", "/a/b.php", false},
+		{"somebot", "/a/b.php?x=1", true},
+		{"crawler/1.0", "/private/a.html", true},
+		{"crawler/1.0", "/tmp/a.html", false},
+	}
+	for _, c := range cases {
+		if robots.Allowed(c.agent, c.urlpath) != c.allowed {
+			t.Error(c.agent, " ", c.urlpath, " expect allowed=", c.allowed)
+		}
+	}
+	if robots.CrawlDelay("crawler/1.0") != 5*time.Second {
+		t.Error("unexpected crawl delay: ", robots.CrawlDelay("crawler/1.0"))
+	}
+	if robots.CrawlDelay("somebot") != 0 {
+		t.Error("unexpected crawl delay for somebot: ", robots.CrawlDelay("somebot"))
+	}
+}
+
+//robots.txt返回5xx时为暂时无法获取，可重试；4xx视为没有限制
+func TestRobotsCacheUnavailable(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cache := lib.InitRobotsCache(&lib.HttpClient{}, "crawler", time.Hour)
+	allowed, err := cache.Check(server.URL, "/index.html")
+	if allowed || err != lib.ErrRobotsUnavailable {
+		t.Error("expect robots unavailable, got ", allowed, err)
+	}
+
+	status = http.StatusNotFound
+	cache = lib.InitRobotsCache(&lib.HttpClient{}, "crawler", time.Hour)
+	allowed, err = cache.Check(server.URL, "/index.html")
+	if !allowed || err != nil {
+		t.Error("expect allowed without robots.txt, got ", allowed, err)
+	}
+}
+
+//CachedCrawlDelay不等待robots.txt，没有缓存时返回0并在后台获取
+func TestRobotsCacheCachedCrawlDelay(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte("User-agent: *\nCrawl-delay: 5\n"))
+	}))
+	defer server.Close()
+
+	cache := lib.InitRobotsCache(&lib.HttpClient{}, "crawler", time.Hour)
+	if delay := cache.CachedCrawlDelay(server.URL); delay != 0 {
+		t.Error("expect no delay before robots.txt is fetched, got ", delay)
+	}
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for cache.CachedCrawlDelay(server.URL) != 5*time.Second {
+		if time.Now().After(deadline) {
+			t.Fatal("robots.txt is not fetched in background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
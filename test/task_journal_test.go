@@ -0,0 +1,75 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zhaozhi406/crawler/fetcher"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+func TestTaskJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tasks.journal")
+
+	journal, pending, err := fetcher.InitTaskJournal(path)
+	if err != nil || len(pending) != 0 {
+		t.Fatal("unexpected new journal: ", pending, err)
+	}
+	journal.Add([]types.TaskPack{{TaskId: 1}, {TaskId: 2}, {TaskId: 3}})
+	journal.Done(2)
+	journal.Close()
+
+	//模拟崩溃时写了一半的记录
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	file.WriteString(`{"op":"done","ta`)
+	file.Close()
+
+	journal, pending, err = fetcher.InitTaskJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].TaskId != 1 || pending[1].TaskId != 3 {
+		t.Fatal("unexpected pending tasks: ", pending)
+	}
+	journal.Done(1, 3)
+	journal.Close()
+
+	_, pending, _ = fetcher.InitTaskJournal(path)
+	if len(pending) != 0 {
+		t.Error("expect no pending tasks, got ", pending)
+	}
+}
+
+//任务完成后再次接收（周期任务再次分发给同一fetcher），重放时只出现一次
+func TestTaskJournalReAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tasks.journal")
+
+	journal, _, err := fetcher.InitTaskJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Add([]types.TaskPack{{TaskId: 5}})
+	journal.Done(5)
+	journal.Add([]types.TaskPack{{TaskId: 5}})
+	journal.Close()
+
+	_, pending, err := fetcher.InitTaskJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].TaskId != 5 {
+		t.Error("expect task 5 replayed once, got ", pending)
+	}
+}
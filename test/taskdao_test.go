@@ -1,13 +1,10 @@
 package test
 
 import (
-	"flag"
-
 	"github.com/jmoiron/sqlx"
 	log "github.com/kdar/factorlog"
 	"github.com/zhaozhi406/crawler/dao"
 	"github.com/zhaozhi406/crawler/types"
-	"github.com/zhaozhi406/crawler/utils"
 )
 
 func test(config map[string]map[string]string) {
@@ -0,0 +1,217 @@
+package test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zhaozhi406/crawler/fetcher"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+func TestWarcPageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warc_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//很小的maxSize，每次抓取后都切换文件
+	store, err := fetcher.InitWarcPageStore(dir, "test", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := types.PageMeta{TaskId: 1, StatusCode: 200, ContentType: "text/html; charset=gbk", Charset: "gbk", FetchTime: 1500000000,
+		Headers: map[string][]string{"Content-Type": {"text/html; charset=gbk"}, "Content-Encoding": {"gzip"}}}
+	key1, err := store.Save("http://www.example.com", "/a?x=1", []byte("<p>v1</p>"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.FetchTime = 1500000100
+	key2, err := store.Save("http://www.example.com", "/a?x=1", []byte("<p>v2</p>"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	warcFiles, _ := filepath.Glob(filepath.Join(dir, "*.warc.gz"))
+	if len(warcFiles) != 2 || strings.Split(key1, ":")[0] == strings.Split(key2, ":")[0] {
+		t.Fatal("expect rotate to 2 files, got ", warcFiles, key1, key2)
+	}
+
+	//整个文件可以作为多member的gzip读取
+	file, _ := os.Open(warcFiles[0])
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(gz)
+	file.Close()
+	for _, warcType := range []string{"warcinfo", "request", "response", "metadata"} {
+		if !strings.Contains(string(content), "WARC-Type: "+warcType+"\r\n") {
+			t.Error("missing ", warcType, " record")
+		}
+	}
+	response := string(content)
+	response = response[strings.Index(response, "WARC-Type: response"):strings.Index(response, "WARC-Type: metadata")]
+	if strings.Contains(response, "Content-Encoding") || !strings.Contains(response, "Content-Type: text/html; charset=utf-8") {
+		t.Error("response headers not fixed: ", response)
+	}
+
+	cdxFile, _ := os.Open(warcFiles[0] + ".cdx")
+	scanner := bufio.NewScanner(cdxFile)
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	cdxFile.Close()
+	if len(lines) != 2 || lines[0] != " CDX N b a m s k r M S V g" {
+		t.Fatal("unexpected cdx: ", lines)
+	}
+	fields := strings.Split(lines[1], " ")
+	if fields[0] != "com,example)/a?x=1" || fields[1] != "20170714024000" || fields[3] != "text/html" || fields[4] != "200" {
+		t.Error("unexpected cdx line: ", lines[1])
+	}
+
+	//重新打开后从cdx恢复索引
+	store, err = fetcher.InitWarcPageStore(dir, "test", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, _ := store.ListVersions("http://www.example.com", "/a?x=1")
+	if len(versions) != 2 || versions[0] != 1500000000 || versions[1] != 1500000100 {
+		t.Error("unexpected versions: ", versions)
+	}
+	version, page, err := store.Latest("http://www.example.com", "/a?x=1")
+	if err != nil || version != 1500000100 || string(page) != "<p>v2</p>" {
+		t.Error("unexpected latest: ", version, string(page), err)
+	}
+	page, err = store.Load(key1)
+	if err != nil || string(page) != "<p>v1</p>" {
+		t.Error("unexpected page: ", string(page), err)
+	}
+	loaded, err := store.LoadMeta(key2)
+	if err != nil || loaded.FetchTime != 1500000100 || loaded.Charset != "gbk" {
+		t.Error("unexpected meta: ", loaded, err)
+	}
+}
+
+//写入失败时截断到写入前的位置，不留下不完整的抓取，之后的写入正常
+func TestWarcPageStoreWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warc_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := fetcher.InitWarcPageStore(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	meta := types.PageMeta{TaskId: 1, StatusCode: 200, FetchTime: 1500000000}
+	key1, err := store.Save("http://www.example.com", "/a", []byte("<p>a</p>"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warcFile := filepath.Join(dir, strings.Split(key1, ":")[0])
+	before, _ := os.Stat(warcFile)
+
+	//cdx文件不可写时，已写入的request, response, metadata记录都要去掉
+	os.Remove(warcFile + ".cdx")
+	if _, err = store.Save("http://www.example.com", "/b", []byte("<p>b</p>"), meta); err == nil {
+		t.Fatal("expect error without cdx file")
+	}
+	after, _ := os.Stat(warcFile)
+	if after.Size() != before.Size() {
+		t.Fatal("expect warc file truncated to ", before.Size(), ", got ", after.Size())
+	}
+
+	ioutil.WriteFile(warcFile+".cdx", []byte(" CDX N b a m s k r M S V g\n"), 0666)
+	key2, err := store.Save("http://www.example.com", "/c", []byte("<p>c</p>"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//整个文件仍是完整的多member gzip，没有失败的抓取的记录
+	file, _ := os.Open(warcFile)
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(gz)
+	file.Close()
+	if err != nil || strings.Contains(string(content), "http://www.example.com/b") || strings.Count(string(content), "WARC-Type: request\r\n") != 2 {
+		t.Error("unexpected warc content: ", string(content), err)
+	}
+	for key, expected := range map[string]string{key1: "<p>a</p>", key2: "<p>c</p>"} {
+		if page, err := store.Load(key); err != nil || string(page) != expected {
+			t.Error("unexpected page of ", key, ": ", string(page), err)
+		}
+	}
+	if versions, _ := store.ListVersions("http://www.example.com", "/b"); len(versions) != 0 {
+		t.Error("failed capture should not be indexed: ", versions)
+	}
+}
+
+//CDX按抓取顺序写入，关闭后按SURT和时间戳排序
+func TestWarcPageStoreCdxSorted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warc_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := fetcher.InitWarcPageStore(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captures := [][2]string{
+		{"http://www.example.org", "/b"},
+		{"http://news.example.com", "/"},
+		{"http://www.example.com", "/z"},
+		{"http://www.example.org", "/a"},
+		{"http://www.example.com", "/a"},
+	}
+	var key string
+	for i, capture := range captures {
+		meta := types.PageMeta{TaskId: int32(i + 1), StatusCode: 200, FetchTime: 1500000000 - int64(i)}
+		key, err = store.Save(capture[0], capture[1], []byte("<p>"+capture[1]+"</p>"), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, strings.Split(key, ":")[0]+".cdx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != len(captures)+1 || lines[0] != " CDX N b a m s k r M S V g" {
+		t.Fatal("unexpected cdx: ", lines)
+	}
+	surts := []string{}
+	for _, line := range lines[1:] {
+		surts = append(surts, strings.Split(line, " ")[0])
+	}
+	expected := []string{"com,example)/a", "com,example)/z", "com,example,news)/", "org,example)/a", "org,example)/b"}
+	if strings.Join(surts, "\n") != strings.Join(expected, "\n") {
+		t.Error("cdx not sorted by surt: ", surts)
+	}
+
+	//排序后的索引仍能找到每个抓取
+	store, err = fetcher.InitWarcPageStore(dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, capture := range captures {
+		if _, page, err := store.Latest(capture[0], capture[1]); err != nil || string(page) != "<p>"+capture[1]+"</p>" {
+			t.Error("unexpected page of ", capture, ": ", string(page), err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zhaozhi406/crawler/fetcher"
+	"github.com/zhaozhi406/crawler/types"
+)
+
+//模拟seaweedfs的master和volume server
+func newWeedStub(t *testing.T, files map[string]string) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir/assign", func(w http.ResponseWriter, req *http.Request) {
+		addr := strings.TrimPrefix(server.URL, "http://")
+		json.NewEncoder(w).Encode(map[string]interface{}{"fid": "3,01637037d6", "url": addr, "publicUrl": addr, "count": 1})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.NotFound(w, req)
+			return
+		}
+		file, header, err := req.FormFile("file")
+		if err != nil {
+			t.Error("upload without file: ", err)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		files[strings.TrimPrefix(req.URL.Path, "/")] = string(data)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": header.Filename, "size": len(data)})
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func TestWeedPageStoreSave(t *testing.T) {
+	files := map[string]string{}
+	server := newWeedStub(t, files)
+	defer server.Close()
+
+	store := fetcher.InitWeedPageStore(server.URL, "", "", nil)
+	key, err := store.Save("http://www.example.com", "/index.html", []byte("<html>hello</html>"), types.PageMeta{TaskId: 5, StatusCode: 200})
+	if err != nil {
+		t.Fatal("save error: ", err)
+	}
+	if key != strings.TrimPrefix(server.URL, "http://")+"/3,01637037d6" {
+		t.Error("unexpected key: ", key)
+	}
+	if files["3,01637037d6"] != "<html>hello</html>" {
+		t.Error("page not uploaded, got: ", files)
+	}
+	if !strings.Contains(files["3,01637037d6_1"], `"task_id":5`) {
+		t.Error("meta not uploaded, got: ", files)
+	}
+}
+
+func TestWeedPageStoreAssignError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "no free volumes"})
+	}))
+	defer server.Close()
+
+	store := fetcher.InitWeedPageStore(server.URL, "", "", nil)
+	_, err := store.Save("http://www.example.com", "/index.html", []byte("<html>hello</html>"), types.PageMeta{TaskId: 5, StatusCode: 200})
+	if err == nil || !strings.Contains(err.Error(), "no free volumes") {
+		t.Error("expect assign error, got: ", err)
+	}
+}
@@ -0,0 +1,33 @@
+package types
+
+//规则的变化监测方式
+const (
+	WATCH_NONE  = iota
+	WATCH_PAGE  //比较整个页面的可见文本
+	WATCH_XPATH //只比较xpath抽取出的字段
+)
+
+//页面变化时post给webhook的事件
+type ChangeEvent struct {
+	TaskId      int32         `json:"task_id"`
+	Url         string        `json:"url"`
+	Watch       int32         `json:"watch"`
+	DetectTime  int64         `json:"detect_time"`
+	PrevPageKey string        `json:"prev_page_key"`
+	PageKey     string        `json:"page_key"`
+	Summary     ChangeSummary `json:"summary"`
+}
+
+//变化摘要，行数为全部变化的数量，AddedLines和RemovedLines最多列出前若干行
+type ChangeSummary struct {
+	Added        int                    `json:"added"`
+	Removed      int                    `json:"removed"`
+	AddedLines   []string               `json:"added_lines,omitempty"`
+	RemovedLines []string               `json:"removed_lines,omitempty"`
+	Fields       map[string]FieldChange `json:"fields,omitempty"` //WATCH_XPATH时变化的字段
+}
+
+type FieldChange struct {
+	Old []string `json:"old"`
+	New []string `json:"new"`
+}
@@ -0,0 +1,20 @@
+package types
+
+import (
+	"time"
+)
+
+//每次抓取的记录
+type CrawlHistory struct {
+	Id int64 `json:"id"`
+	FetchReport
+	CreateTime time.Time `json:"create_time" db:"create_time"`
+}
+
+//任务的抓取历史，供查询接口返回
+type TaskHistory struct {
+	Task                 CrawlTask      `json:"task"`
+	LastSuccess          *CrawlHistory  `json:"last_success"`           //最近一次成功的抓取，没有则为null
+	FailuresSinceSuccess int64          `json:"failures_since_success"` //最近一次成功之后失败的次数
+	Attempts             []CrawlHistory `json:"attempts"`               //按时间倒序
+}
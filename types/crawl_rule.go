@@ -5,13 +5,17 @@ import (
 )
 
 type CrawlRule struct {
-	Id         int32
-	Domain     string
-	Urlpath    string
-	Xpath      string
-	Cycle      int32
-	Priority   int32
-	CreateTime time.Time `db:"create_time"`
-	UpdateTime time.Time `db:"update_time"`
-	Status     int32
+	Id           int32
+	Domain       string
+	Urlpath      string
+	Xpath        string
+	Cycle        int32
+	Priority     int32
+	FollowLinks  bool      `db:"follow_links"`
+	IgnoreRobots bool      `db:"ignore_robots"` //已获站点许可，不遵守robots.txt
+	Watch        int32     //变化监测方式，见WATCH_*
+	Webhook      string    //页面变化时通知的地址，为空则使用fetcher配置的change_webhook
+	CreateTime   time.Time `db:"create_time"`
+	UpdateTime   time.Time `db:"update_time"`
+	Status       int32
 }
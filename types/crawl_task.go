@@ -8,11 +8,30 @@ type CrawlTask struct {
 	Id            int32
 	Domain        string
 	Urlpath       string
+	Xpath         string
 	Priority      int32
 	Cycle         int32
 	Status        int32
-	LastCrawlTime int64     `db:"last_crawl_time"`
-	CrawlTimes    int32     `db:"crawl_times"`
+	LastCrawlTime int64 `db:"last_crawl_time"`
+	CrawlTimes    int32 `db:"crawl_times"`
+	LeaseExpire   int64 `db:"lease_expire"` //分发后的租约到期时间，到期未报告则重新等待调度
+	RetryTimes    int32 `db:"retry_times"`
+	NextRetryTime int64 `db:"next_retry_time"` //失败后下次可重试的时间
+	FollowLinks   bool  `db:"follow_links"`
+	IgnoreRobots  bool  `db:"ignore_robots"`
+	Watch         int32
+	Webhook       string
+	PageKey       string `db:"page_key"`
+	DataKey       string `db:"data_key"`
+	Etag          string //上次抓取返回的ETag，周期任务重抓时用于条件请求
+	LastModified  string `db:"last_modified"`
+	ContentHash   string `db:"content_hash"`
+	Simhash       uint64
+	SimhashBand0  uint16    `db:"simhash_band0"` //SimHash按16位切成的4段，各自有索引，用于查找近似的任务
+	SimhashBand1  uint16    `db:"simhash_band1"`
+	SimhashBand2  uint16    `db:"simhash_band2"`
+	SimhashBand3  uint16    `db:"simhash_band3"`
+	DuplicateOf   int32     `db:"duplicate_of"` //其他domain上内容近似的任务（镜像站点），没有则为0
 	CreateTime    time.Time `db:"create_time"`
 	UpdateTime    time.Time `db:"update_time"`
 }
@@ -0,0 +1,8 @@
+package types
+
+type ExtractResult struct {
+	TaskId    int32               `json:"task_id"`
+	Url       string              `json:"url"`
+	FetchTime int64               `json:"fetch_time"`
+	Fields    map[string][]string `json:"fields"`
+}
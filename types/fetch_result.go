@@ -0,0 +1,50 @@
+package types
+
+//fetcher向scheduler报告的抓取结果（report接口的done参数）
+const (
+	FETCH_FAILED = iota
+	FETCH_DONE
+	FETCH_ROBOTS_DENIED
+)
+
+//抓取失败的错误分类
+const (
+	ERR_CLASS_DNS           = "dns"
+	ERR_CLASS_TIMEOUT       = "timeout"
+	ERR_CLASS_CONNECT       = "connect"
+	ERR_CLASS_4XX           = "4xx"
+	ERR_CLASS_5XX           = "5xx"
+	ERR_CLASS_ROBOTS_DENIED = "robots_denied"
+	ERR_CLASS_ROBOTS_ERROR  = "robots_error" //robots.txt暂时无法获取，可重试
+	ERR_CLASS_TOO_LARGE     = "too_large"    //超过max_body_bytes
+	ERR_CLASS_STORE         = "store"        //页面保存失败，可重试
+	ERR_CLASS_OTHER         = "other"
+)
+
+//fetcher以json形式post给scheduler的抓取报告
+type FetchReport struct {
+	//fetcher生成的报告id，scheduler据此忽略重复投递的报告
+	ReportId    string `json:"report_id,omitempty" db:"report_id"`
+	TaskId      int32  `json:"task_id" db:"task_id"`
+	Done        int    `json:"done" db:"done"`
+	StatusCode  int    `json:"status_code" db:"status_code"`
+	FinalUrl    string `json:"final_url" db:"final_url"` //跟随跳转后的最终地址
+	ContentType string `json:"content_type" db:"content_type"`
+	Bytes       int64  `json:"bytes" db:"bytes"`
+	Latency     int64  `json:"latency" db:"latency"` //毫秒
+	ErrorClass  string `json:"error_class,omitempty" db:"error_class"`
+	ErrorMsg    string `json:"error_msg,omitempty" db:"error_msg"`
+	PageKey     string `json:"page_key,omitempty" db:"page_key"`
+	DataKey     string `json:"data_key,omitempty" db:"data_key"`
+	FetchTime   int64  `json:"fetch_time" db:"fetch_time"`
+	//响应中的缓存校验信息，scheduler保存后下次抓取时用于条件请求
+	Etag         string `json:"etag,omitempty" db:"etag"`
+	LastModified string `json:"last_modified,omitempty" db:"last_modified"`
+	//页面内容指纹：精确hash和SimHash
+	ContentHash string `json:"content_hash,omitempty" db:"content_hash"`
+	Simhash     uint64 `json:"simhash,string" db:"simhash"`
+	//内容与上一版本完全相同，未保存新版本
+	Unchanged bool `json:"unchanged" db:"unchanged"`
+	//与上一版本近似（SimHash距离小于阈值），由scheduler计算
+	NearDuplicate bool `json:"near_duplicate" db:"near_duplicate"`
+}
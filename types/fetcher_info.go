@@ -0,0 +1,16 @@
+package types
+
+//fetcher注册和心跳时上报的信息
+type FetcherInfo struct {
+	Addr      string `json:"addr"` //scheduler推送任务的地址，同时用于礼貌访问控制
+	Workers   int    `json:"workers"`
+	QueueSize int    `json:"queue_size"`
+	TaskMode  string `json:"task_mode,omitempty"`
+	TaskQueue string `json:"task_queue,omitempty"` //redis模式下的任务队列名
+	QueueLen  int    `json:"queue_len"`            //队列中等待抓取的任务数
+	FreeSlots int    `json:"free_slots"`           //队列的空闲位置数，退出中为0
+	//以下由scheduler填写
+	RegisterTime  int64 `json:"register_time,omitempty"`
+	LastHeartbeat int64 `json:"last_heartbeat,omitempty"`
+	Live          bool  `json:"live"`
+}
@@ -0,0 +1,12 @@
+package types
+
+//与页面一起保存的抓取元数据，重新处理页面时需要用到
+type PageMeta struct {
+	TaskId      int32               `json:"task_id"`
+	Url         string              `json:"url"`
+	StatusCode  int                 `json:"status_code"`
+	Headers     map[string][]string `json:"headers"`
+	ContentType string              `json:"content_type"`
+	Charset     string              `json:"charset"` //页面原来的编码，保存的内容已转为utf-8
+	FetchTime   int64               `json:"fetch_time"`
+}
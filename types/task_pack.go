@@ -1,8 +1,17 @@
 package types
 
 type TaskPack struct {
-	TaskId      int32  `json:"task_id"`
-	Domain      string `json:"domain"`
-	Urlpath     string `json:"urlpath"`
-	FollowLinks bool   `json:"follow"`
+	TaskId       int32  `json:"task_id"`
+	Domain       string `json:"domain"`
+	Urlpath      string `json:"urlpath"`
+	FollowLinks  bool   `json:"follow"`
+	Xpath        string `json:"xpath,omitempty"`
+	IgnoreRobots bool   `json:"ignore_robots,omitempty"`
+	Etag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ContentHash  string `json:"content_hash,omitempty"` //上次抓取内容的hash，内容未变时不保存新版本
+	Watch        int32  `json:"watch,omitempty"`
+	Webhook      string `json:"webhook,omitempty"`
+	PageKey      string `json:"page_key,omitempty"` //上一版本页面和抽取结果的key，用于变化监测
+	DataKey      string `json:"data_key,omitempty"`
 }